@@ -2,30 +2,95 @@ package application
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/redis/go-redis/v9"
+
+	"github.com/gaylonalfano/go-redis-crud/codec"
+	"github.com/gaylonalfano/go-redis-crud/idempotency"
+	"github.com/gaylonalfano/go-redis-crud/idgen"
+	"github.com/gaylonalfano/go-redis-crud/repository/order"
 )
 
 type App struct {
 	// Give this router type a general type (http.Handler), so it's uncoupled from Chi
 	router http.Handler
-	rdb    *redis.Client
-	config Config
+	// NOTE: rdb is nil when running with the in-memory storage backend
+	rdb  redis.UniversalClient
+	repo order.Repo
+	ids  idgen.Generator
+	// Read-only replicas of rdb, if any
+	replicas []redis.UniversalClient
+	// Responses stored for requests with an Idempotency-Key
+	idempotency idempotency.Store
+	config      Config
+	// Closed once Start's context is cancelled, to tell long-lived
+	// requests (e.g. event streams) to wrap up before the server stops
+	shutdown chan struct{}
 }
 
 // Constructor method returns a pointer to our instance of the App type
 func New(config Config) *App {
 	// Create an instance of our App type and assign to 'app' variable
 	app := &App{
-		rdb: redis.NewClient(&redis.Options{
-			Addr: config.RedisAddress,
-		}),
-		config: config,
+		config:   config,
+		shutdown: make(chan struct{}),
+	}
+
+	// U: Pick the datastore based on Config. Handlers only see order.Repo
+	switch config.Storage {
+	case StorageMemory:
+		repo := order.NewMemoryRepo()
+		repo.EventStreamMaxLen = config.EventStreamMaxLen
+		app.repo = repo
+		app.idempotency = idempotency.NewMemoryStore()
+	default:
+		app.rdb = config.newRedisClient()
+		layout := config.RedisLayout
+		if layout != order.LayoutJSON && layout != order.LayoutHash {
+			fmt.Println("Unknown redis order layout, using json:", layout)
+			layout = order.LayoutJSON
+		}
+		orderCodec, err := codec.ByName(config.OrderCodec)
+		if err != nil {
+			fmt.Println("Failed to pick order codec, using json:", err)
+			orderCodec = codec.JSON{}
+		}
+		readPolicy := config.ReadPolicy
+		switch readPolicy {
+		case order.ReadPrimary, order.ReadReplicas, order.ReadYourWrites:
+		default:
+			fmt.Println("Unknown read policy, using read-your-writes:", readPolicy)
+			readPolicy = order.ReadYourWrites
+			app.config.ReadPolicy = readPolicy
+		}
+		for _, addr := range config.RedisReplicaAddrs {
+			app.replicas = append(app.replicas, redis.NewClient(&redis.Options{
+				Addr: addr,
+			}))
+		}
+		app.repo = &order.RedisRepo{
+			Client:            app.rdb,
+			EventStream:       config.EventStream,
+			EventStreamMaxLen: config.EventStreamMaxLen,
+			Layout:            layout,
+			Codec:             orderCodec,
+			CompressAbove:     config.CompressAbove,
+
+			Replicas:             app.replicas,
+			ReadPolicy:           readPolicy,
+			ReadYourWritesWindow: config.ReadYourWritesWindow,
+		}
+		app.idempotency = &idempotency.RedisStore{
+			Client: app.rdb,
+		}
 	}
 
+	app.ids = app.newIDGenerator()
+
 	// U: Now that we've changed it to (a *App) loadRoutes(),
 	// we can just call it directly on the App, since we've already
 	// assigned the a.router property to be our router
@@ -34,6 +99,61 @@ func New(config Config) *App {
 	return app
 }
 
+// Connect to whichever kind of Redis deployment Config describes. They
+// all satisfy redis.UniversalClient, so nothing else needs to know which.
+// NOTE: Every order key shares the {orders} hash tag, which is what keeps
+// the repo's MULTI/EXEC transactions valid on a cluster or ring, at the
+// cost of keeping all orders on one node (see Config.RedisClusterAddrs).
+func (c Config) newRedisClient() redis.UniversalClient {
+	switch {
+	case len(c.RedisClusterAddrs) > 0:
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs: c.RedisClusterAddrs,
+		})
+	case c.RedisSentinelMaster != "":
+		sentinels := c.RedisSentinelAddrs
+		if len(sentinels) == 0 {
+			sentinels = []string{c.RedisAddress}
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:    c.RedisSentinelMaster,
+			SentinelAddrs: sentinels,
+		})
+	case len(c.RedisRingShards) > 0:
+		return redis.NewRing(&redis.RingOptions{
+			Addrs: c.RedisRingShards,
+		})
+	default:
+		return redis.NewClient(&redis.Options{
+			Addr: c.RedisAddress,
+		})
+	}
+}
+
+// Pick the order ID generator based on Config, falling back to snowflake
+// IDs when the requested one can't be used
+func (a *App) newIDGenerator() idgen.Generator {
+	switch a.config.IDGenerator {
+	case IDGeneratorRandom:
+		return idgen.Random{}
+	case IDGeneratorRedis:
+		if a.rdb != nil {
+			return &idgen.RedisSequence{Client: a.rdb}
+		}
+		fmt.Println("Redis ID sequence needs redis storage, using snowflake IDs")
+	case IDGeneratorSnowflake:
+	default:
+		fmt.Println("Unknown ID generator, using snowflake IDs:", a.config.IDGenerator)
+	}
+
+	snowflake, err := idgen.NewSnowflake(a.config.NodeID)
+	if err != nil {
+		fmt.Println("Failed to create snowflake generator, using node 0:", err)
+		snowflake, _ = idgen.NewSnowflake(0)
+	}
+	return snowflake
+}
+
 // You define the receiver of this new method using this syntax
 // Kinda like the JS 'this' keyword
 func (a *App) Start(ctx context.Context) error {
@@ -44,18 +164,42 @@ func (a *App) Start(ctx context.Context) error {
 		Handler: a.router,
 	}
 
-	err := a.rdb.Ping(ctx).Err()
-	if err != nil {
-		return fmt.Errorf("Failed to connect to redis: %w", err)
-	}
+	var err error
+	if a.rdb != nil {
+		err = a.rdb.Ping(ctx).Err()
+		if err != nil {
+			return fmt.Errorf("Failed to connect to redis: %w", err)
+		}
+
+		// U: Adding this final defer with anon function
+		// to ensure it shutdown
+		defer func() {
+			if err := a.rdb.Close(); err != nil {
+				fmt.Println("Failed to close redis", err)
+			}
+			for _, replica := range a.replicas {
+				if err := replica.Close(); err != nil {
+					fmt.Println("Failed to close redis replica", err)
+				}
+			}
+		}()
 
-	// U: Adding this final defer with anon function
-	// to ensure it shutdown
-	defer func() {
-		if err := a.rdb.Close(); err != nil {
-			fmt.Println("Failed to close redis", err)
+		// NOTE: Replicas aren't required to be up, reads fall back to
+		// the primary until they are
+		for _, replica := range a.replicas {
+			if err := replica.Ping(ctx).Err(); err != nil {
+				fmt.Println("Failed to connect to redis replica:", err)
+			}
 		}
-	}()
+
+		if err := a.migrate(ctx); err != nil {
+			return err
+		}
+	}
+
+	if a.config.DeletedRetention > 0 {
+		go a.purgeDeleted(ctx)
+	}
 
 	fmt.Println("Starting server on port", server.Addr)
 
@@ -98,6 +242,10 @@ func (a *App) Start(ctx context.Context) error {
 		// again, so we don't wait for our server's Go routine to be deadlocked.
 		return err
 	case <-ctx.Done():
+		// NOTE: server.Shutdown() waits for active requests to finish,
+		// which streaming requests never would on their own
+		close(a.shutdown)
+
 		// Now we can gracefully shutdown our server
 		// Give it 10 seconds to give any inflight requests time to resolve
 		timeout, cancel := context.WithTimeout(context.Background(), time.Second*10)
@@ -116,6 +264,77 @@ func (a *App) Start(ctx context.Context) error {
 	// 	// Channel was closed
 	// 	fmt.Println("Channel was closed")
 	// }
+}
+
+// How often the trash is checked for orders past DeletedRetention
+const purgeInterval = time.Hour
+
+// Purge orders that have been in the trash longer than DeletedRetention,
+// until ctx is cancelled
+func (a *App) purgeDeleted(ctx context.Context) {
+	// Show up in the purged orders' history as the retention sweep
+	ctx = order.WithAuditInfo(ctx, order.AuditInfo{Actor: "retention"})
+
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		before := time.Now().Add(-a.config.DeletedRetention)
+		n, err := a.repo.PurgeDeleted(ctx, before)
+		if err != nil && ctx.Err() == nil {
+			fmt.Println("Failed to purge deleted orders:", err)
+		} else if n > 0 {
+			fmt.Println("Purged deleted orders:", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Run any one-off data migrations requested via Config before serving
+func (a *App) migrate(ctx context.Context) error {
+	repo, ok := a.repo.(*order.RedisRepo)
+	if !ok {
+		return nil
+	}
+
+	if a.config.MigrateKeys {
+		n, err := repo.MigrateKeyLayout(ctx)
+		if err != nil {
+			return fmt.Errorf("Failed to migrate order keys: %w", err)
+		}
+		fmt.Println("Renamed order keys:", n)
+	} else {
+		// NOTE: Orders under the old key names would silently vanish from
+		// the API, so refuse to start rather than serve without them
+		untagged, err := repo.HasUntaggedKeys(ctx)
+		if err != nil {
+			return err
+		}
+		if untagged {
+			return errors.New("Found order keys without the {orders} hash tag, restart with MIGRATE_KEYS=true to rename them")
+		}
+	}
+
+	if a.config.MigrateIndex {
+		n, err := repo.MigrateLegacyIndex(ctx)
+		if err != nil {
+			return fmt.Errorf("Failed to migrate orders index: %w", err)
+		}
+		fmt.Println("Migrated orders into created-order index:", n)
+	}
+
+	if a.config.RebuildIndexes {
+		n, err := repo.RebuildIndexes(ctx)
+		if err != nil {
+			return fmt.Errorf("Failed to rebuild order indexes: %w", err)
+		}
+		fmt.Println("Rebuilt indexes for orders:", n)
+	}
 
 	return nil
 }
@@ -1,22 +1,118 @@
 package application
 
 import (
+	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gaylonalfano/go-redis-crud/repository/order"
+)
+
+// Which order.Repo implementation the App should wire up
+const (
+	StorageRedis  = "redis"
+	StorageMemory = "memory"
+)
+
+// How new order IDs are generated (see the idgen package)
+const (
+	IDGeneratorSnowflake = "snowflake"
+	IDGeneratorRedis     = "redis"
+	IDGeneratorRandom    = "random"
 )
 
 type Config struct {
 	RedisAddress string
 	ServerPort   uint16
+	// Set at most one of these to use something other than the single
+	// node at RedisAddress (see App.newRedisClient).
+	//
+	// NOTE: Every order key (orders, histories, indexes and the event
+	// stream) shares the {orders} hash tag so the repository's MULTI/EXEC
+	// transactions stay valid. That means all of the order data lives in
+	// one hash slot, on ONE node: a cluster or ring gives failover and
+	// room for other data, but doesn't spread orders across nodes or add
+	// capacity for them. A Ring only shards, so for orders it's no better
+	// than a single node.
+	//
+	// Seed nodes of a Redis Cluster. Orders all live on the master
+	// owning the {orders} slot (and its replicas).
+	RedisClusterAddrs []string
+	// Name of the master to ask the sentinels for. The sentinels are at
+	// RedisSentinelAddrs, or RedisAddress if that's empty
+	RedisSentinelMaster string
+	RedisSentinelAddrs  []string
+	// Shard name to address of each node of a client-side Ring. Orders
+	// all live on whichever shard {orders} hashes to.
+	RedisRingShards map[string]string
+	// Read-only replicas of the primary, and which reads go to them
+	// (one of the order.Read* policies). With order.ReadYourWrites a
+	// client's reads go to the primary for ReadYourWritesWindow after
+	// it writes something.
+	RedisReplicaAddrs    []string
+	ReadPolicy           order.ReadPolicy
+	ReadYourWritesWindow time.Duration
+	// Either StorageRedis or StorageMemory (no Redis server needed)
+	Storage string
+	// How orders are stored in Redis (order.LayoutJSON or order.LayoutHash).
+	// Existing orders aren't converted when this is changed.
+	RedisLayout order.Layout
+	// How orders are encoded with the json layout: "json", "msgpack" or
+	// "binary" (see the codec package). Orders already stored with another
+	// codec can still be read.
+	OrderCodec string
+	// Gzip stored orders bigger than this many bytes. Zero turns it off.
+	CompressAbove int
+	// Rename keys written before every key had the {orders} hash tag
+	// on startup. Needs a single node, so run it before moving to a cluster.
+	// Without it, the app won't start while any of those keys are left.
+	MigrateKeys bool
+	// Copy the legacy "orders" set into the created-order index on startup
+	MigrateIndex bool
+	// Re-add every stored order to the orders and customer indexes on startup
+	RebuildIndexes bool
+	// Stream order lifecycle events are published to, and its MAXLEN ~ trim.
+	// With a cluster or ring the stream needs the {orders} hash tag too.
+	EventStream       string
+	EventStreamMaxLen int64
+	// One of the IDGenerator* constants. NodeID must be unique per
+	// running instance when using snowflake IDs
+	IDGenerator string
+	NodeID      uint16
+	// How long responses to requests with an Idempotency-Key are kept
+	IdempotencyTTL time.Duration
+	// Tax charged on new orders, in basis points (825 is 8.25%)
+	TaxRate uint
+	// How long deleted orders stay in the trash before they're purged
+	// automatically, e.g. DELETED_RETENTION=720h for 30 days. Zero (the
+	// default) keeps them until they're purged by hand.
+	DeletedRetention time.Duration
 }
 
 // Create a func to return an instance of our Config
 // NOTE: viper and envconfig packages can do this as well
-func LoadConfig() Config {
+func LoadConfig() (Config, error) {
 	// Create instance with defaults
 	cfg := Config{
 		RedisAddress: "localhost:6379",
 		ServerPort:   3000,
+		Storage:      StorageRedis,
+
+		ReadPolicy:           order.ReadYourWrites,
+		ReadYourWritesWindow: order.DefaultReadYourWritesWindow,
+
+		RedisLayout:   order.LayoutJSON,
+		OrderCodec:    "json",
+		CompressAbove: 4096,
+
+		EventStream:       order.DefaultEventStream,
+		EventStreamMaxLen: order.DefaultEventStreamMaxLen,
+
+		IDGenerator: IDGeneratorSnowflake,
+
+		IdempotencyTTL: 24 * time.Hour,
 	}
 
 	// Import ENV variables using os package
@@ -25,11 +121,140 @@ func LoadConfig() Config {
 		cfg.RedisAddress = redisAddr
 	}
 
+	if addrs, exists := os.LookupEnv("REDIS_CLUSTER_ADDRS"); exists {
+		cfg.RedisClusterAddrs = splitList(addrs)
+	}
+
+	if master, exists := os.LookupEnv("REDIS_SENTINEL_MASTER"); exists {
+		cfg.RedisSentinelMaster = master
+	}
+
+	if addrs, exists := os.LookupEnv("REDIS_SENTINEL_ADDRS"); exists {
+		cfg.RedisSentinelAddrs = splitList(addrs)
+	}
+
+	// e.g. REDIS_RING_SHARDS=shard1=10.0.0.1:6379,shard2=10.0.0.2:6379
+	if shards, exists := os.LookupEnv("REDIS_RING_SHARDS"); exists {
+		cfg.RedisRingShards = make(map[string]string)
+		for _, shard := range splitList(shards) {
+			if name, addr, ok := strings.Cut(shard, "="); ok {
+				cfg.RedisRingShards[name] = addr
+			}
+		}
+	}
+
+	if addrs, exists := os.LookupEnv("REDIS_REPLICA_ADDRS"); exists {
+		cfg.RedisReplicaAddrs = splitList(addrs)
+	}
+
+	if policy, exists := os.LookupEnv("REDIS_READ_POLICY"); exists {
+		cfg.ReadPolicy = order.ReadPolicy(policy)
+	}
+
+	if window, exists := os.LookupEnv("READ_YOUR_WRITES_WINDOW"); exists {
+		if d, err := time.ParseDuration(window); err == nil && d > 0 {
+			cfg.ReadYourWritesWindow = d
+		}
+	}
+
 	if serverPort, exists := os.LookupEnv("SERVER_PORT"); exists {
 		if port, err := strconv.ParseUint(serverPort, 10, 16); err == nil {
 			cfg.ServerPort = uint16(port)
 		}
 	}
 
-	return cfg
+	if storage, exists := os.LookupEnv("STORAGE_BACKEND"); exists {
+		cfg.Storage = storage
+	}
+
+	if layout, exists := os.LookupEnv("REDIS_ORDER_LAYOUT"); exists {
+		cfg.RedisLayout = order.Layout(layout)
+	}
+
+	if orderCodec, exists := os.LookupEnv("ORDER_CODEC"); exists {
+		cfg.OrderCodec = orderCodec
+	}
+
+	if compressAbove, exists := os.LookupEnv("ORDER_COMPRESS_ABOVE"); exists {
+		if n, err := strconv.Atoi(compressAbove); err == nil && n >= 0 {
+			cfg.CompressAbove = n
+		}
+	}
+
+	if migrate, exists := os.LookupEnv("MIGRATE_KEYS"); exists {
+		if b, err := strconv.ParseBool(migrate); err == nil {
+			cfg.MigrateKeys = b
+		}
+	}
+
+	if migrate, exists := os.LookupEnv("MIGRATE_ORDER_INDEX"); exists {
+		if b, err := strconv.ParseBool(migrate); err == nil {
+			cfg.MigrateIndex = b
+		}
+	}
+
+	if rebuild, exists := os.LookupEnv("REBUILD_ORDER_INDEXES"); exists {
+		if b, err := strconv.ParseBool(rebuild); err == nil {
+			cfg.RebuildIndexes = b
+		}
+	}
+
+	if stream, exists := os.LookupEnv("EVENT_STREAM"); exists {
+		cfg.EventStream = stream
+	}
+
+	if maxLen, exists := os.LookupEnv("EVENT_STREAM_MAXLEN"); exists {
+		if n, err := strconv.ParseInt(maxLen, 10, 64); err == nil && n > 0 {
+			cfg.EventStreamMaxLen = n
+		}
+	}
+
+	if generator, exists := os.LookupEnv("ID_GENERATOR"); exists {
+		cfg.IDGenerator = generator
+	}
+
+	if nodeID, exists := os.LookupEnv("NODE_ID"); exists {
+		if id, err := strconv.ParseUint(nodeID, 10, 16); err == nil {
+			cfg.NodeID = uint16(id)
+		}
+	}
+
+	if ttl, exists := os.LookupEnv("IDEMPOTENCY_TTL"); exists {
+		if d, err := time.ParseDuration(ttl); err == nil && d > 0 {
+			cfg.IdempotencyTTL = d
+		}
+	}
+
+	if retention, exists := os.LookupEnv("DELETED_RETENTION"); exists {
+		if d, err := time.ParseDuration(retention); err == nil && d >= 0 {
+			cfg.DeletedRetention = d
+		}
+	}
+
+	if taxRate, exists := os.LookupEnv("TAX_RATE_BPS"); exists {
+		if bps, err := strconv.ParseUint(taxRate, 10, 16); err == nil {
+			cfg.TaxRate = uint(bps)
+		}
+	}
+
+	// NOTE: A cluster or ring rejects a transaction touching keys in
+	// different slots (CROSSSLOT), and the stream is written in the same
+	// MULTI/EXEC as the orders, so every write would fail
+	clustered := len(cfg.RedisClusterAddrs) > 0 || len(cfg.RedisRingShards) > 0
+	if cfg.Storage == StorageRedis && clustered && !order.HasKeyTag(cfg.EventStream) {
+		return cfg, fmt.Errorf("EVENT_STREAM %q must contain the {orders} hash tag on a redis cluster or ring", cfg.EventStream)
+	}
+
+	return cfg, nil
+}
+
+// Split a comma separated env var, dropping empty entries
+func splitList(s string) []string {
+	var list []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
 }
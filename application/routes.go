@@ -4,6 +4,8 @@ import (
 	"net/http"
 
 	"github.com/gaylonalfano/go-redis-crud/handler"
+	"github.com/gaylonalfano/go-redis-crud/idempotency"
+	"github.com/gaylonalfano/go-redis-crud/problem"
 	"github.com/gaylonalfano/go-redis-crud/repository/order"
 
 	"github.com/go-chi/chi/v5"
@@ -15,7 +17,22 @@ import (
 // to easily access App properties
 func (a *App) loadRoutes() {
 	router := chi.NewRouter()
+	router.Use(middleware.RequestID)
 	router.Use(middleware.Logger)
+	// Record who's making each request in the order history
+	router.Use(handler.AuditContext)
+	// Only replicas can be behind, so the cookie is only needed with them
+	if len(a.replicas) > 0 && a.config.ReadPolicy == order.ReadYourWrites {
+		router.Use(handler.ReadYourWrites(a.config.ReadYourWritesWindow))
+	}
+
+	// Unknown routes get problem+json bodies like every other error
+	router.NotFound(func(w http.ResponseWriter, r *http.Request) {
+		problem.Write(w, r, problem.New(http.StatusNotFound, ""))
+	})
+	router.MethodNotAllowed(func(w http.ResponseWriter, r *http.Request) {
+		problem.Write(w, r, problem.New(http.StatusMethodNotAllowed, ""))
+	})
 
 	// func(){} is an anonymous function syntax
 	router.Get("/", func(w http.ResponseWriter, r *http.Request) {
@@ -25,6 +42,7 @@ func (a *App) loadRoutes() {
 	// Create/setup a subrouter for the /orders path
 	// NOTE: This is a short-hand for Mount()
 	router.Route("/orders", a.loadOrderRoutes)
+	router.Route("/customers", a.loadCustomerRoutes)
 
 	// U: Instead of returning a *chi.Mux router, we just
 	// update/assign our App's router property to this router
@@ -34,14 +52,44 @@ func (a *App) loadRoutes() {
 func (a *App) loadOrderRoutes(router chi.Router) {
 	// Use '&' to take the memory address of the instance
 	orderHandler := &handler.Order{
-		Repo: &order.RedisRepo{
-			Client: a.rdb,
-		},
+		Repo:     a.repo,
+		IDs:      a.ids,
+		TaxRate:  a.config.TaxRate,
+		Shutdown: a.shutdown,
 	}
 
-	router.Post("/", orderHandler.Create)
+	// Retried creates with the same Idempotency-Key get the first response
+	// back instead of creating another order. Each route reads the body
+	// with its own handler's size limit.
+	idempotent := func(maxBodyBytes int64) func(http.Handler) http.Handler {
+		return idempotency.Middleware(a.idempotency, a.config.IdempotencyTTL, maxBodyBytes)
+	}
+	router.With(idempotent(handler.MaxCreateBytes)).Post("/", orderHandler.Create)
+	router.With(idempotent(handler.MaxBatchBytes)).Post("/batch", orderHandler.CreateBatch)
+	router.Post("/bulk-status", orderHandler.BulkStatus)
 	router.Get("/", orderHandler.List)
 	router.Get("/{id}", orderHandler.GetByID)
+	// NOTE: PUT only changes the status, it's kept for older clients.
+	// PATCH can change anything that's mutable.
 	router.Put("/{id}", orderHandler.UpdateByID)
+	router.Patch("/{id}", orderHandler.PatchByID)
 	router.Delete("/{id}", orderHandler.DeleteByID)
+	router.Post("/{id}/restore", orderHandler.Restore)
+	router.Get("/{id}/history", orderHandler.History)
+	// Line items can be changed until the order ships
+	router.Get("/{id}/items", orderHandler.ListItems)
+	router.Post("/{id}/items", orderHandler.AddItem)
+	router.Patch("/{id}/items/{itemID}", orderHandler.UpdateItem)
+	router.Delete("/{id}/items/{itemID}", orderHandler.RemoveItem)
+	// Server-Sent Events streams of order changes
+	router.Get("/events", orderHandler.Events)
+	router.Get("/{id}/events", orderHandler.EventsByID)
+}
+
+func (a *App) loadCustomerRoutes(router chi.Router) {
+	orderHandler := &handler.Order{
+		Repo: a.repo,
+	}
+
+	router.Get("/{customerID}/orders", orderHandler.ListByCustomer)
 }
@@ -0,0 +1,246 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+// Binary is a compact encoding with no field names: every field is
+// written in a fixed order, numbers as varints and IDs as their 16 raw
+// bytes. The smallest and fastest, but the layout below can only be
+// changed by adding a new binaryVersion.
+type Binary struct{}
+
+func (Binary) Format() Format { return FormatBinary }
+
+// Bumped whenever the layout changes, so older values can still be read
+const binaryVersion = 1
+
+var errTruncated = errors.New("value is truncated")
+
+// The order's optional timestamps, in the order they're encoded. In the
+// binary encoding each one has a bit in the "present" flags.
+func timestamps(order *model.Order) []**time.Time {
+	return []**time.Time{
+		&order.CreatedAt,
+		&order.PaidAt,
+		&order.ShippedAt,
+		&order.DeliveredAt,
+		&order.CompletedAt,
+		&order.CancelledAt,
+		&order.RefundedAt,
+		&order.ReturnedAt,
+		&order.DeletedAt,
+	}
+}
+
+// The JSON (and MessagePack) names of timestamps(order)
+var timestampNames = []string{
+	"created_at",
+	"paid_at",
+	"shipped_at",
+	"delivered_at",
+	"completed_at",
+	"cancelled_at",
+	"refunded_at",
+	"returned_at",
+	"deleted_at",
+}
+
+func (Binary) Marshal(order model.Order) ([]byte, error) {
+	w := binWriter{buf: make([]byte, 0, 128+64*len(order.LineItems))}
+
+	w.uint(binaryVersion)
+	w.uint(order.OrderID)
+	w.uuid(order.CustomerID)
+	w.uint(order.Revision)
+	w.string(string(order.Status))
+	w.string(order.Notes)
+
+	var present uint64
+	for i, t := range timestamps(&order) {
+		if *t != nil {
+			present |= 1 << i
+		}
+	}
+	w.uint(present)
+	for _, t := range timestamps(&order) {
+		if *t != nil {
+			w.int((*t).UnixNano())
+		}
+	}
+
+	w.uint(uint64(len(order.LineItems)))
+	for _, item := range order.LineItems {
+		w.uuid(item.ItemID)
+		w.uint(uint64(item.Quantity))
+		w.money(item.Price)
+		w.money(item.Subtotal)
+	}
+
+	w.money(order.Totals.Subtotal)
+	w.money(order.Totals.Discount)
+	w.uint(uint64(order.Totals.TaxRate))
+	w.money(order.Totals.Tax)
+	w.money(order.Totals.Total)
+
+	if a := order.ShippingAddress; a != nil {
+		w.uint(1)
+		for _, s := range []string{a.Name, a.Line1, a.Line2, a.City, a.Region, a.PostalCode, a.Country} {
+			w.string(s)
+		}
+	} else {
+		w.uint(0)
+	}
+
+	return w.buf, nil
+}
+
+func (Binary) Unmarshal(data []byte, order *model.Order) error {
+	r := binReader{data: data}
+
+	if version := r.uint(); r.err == nil && version != binaryVersion {
+		return fmt.Errorf("unsupported binary version %d", version)
+	}
+
+	var o model.Order
+	o.OrderID = r.uint()
+	o.CustomerID = r.uuid()
+	o.Revision = r.uint()
+	o.Status = model.Status(r.string())
+	o.Notes = r.string()
+
+	present := r.uint()
+	for i, t := range timestamps(&o) {
+		if present&(1<<i) != 0 {
+			at := time.Unix(0, r.int()).UTC()
+			*t = &at
+		}
+	}
+
+	// NOTE: Don't trust the count enough to allocate it up front, a
+	// corrupt value could ask for anything. Each item is at least 20 bytes.
+	n := r.uint()
+	if n > uint64(len(r.data)/20) {
+		return errTruncated
+	}
+	if n > 0 {
+		o.LineItems = make([]model.LineItem, n)
+	}
+	for i := range o.LineItems {
+		item := &o.LineItems[i]
+		item.ItemID = r.uuid()
+		item.Quantity = uint(r.uint())
+		item.Price = r.money()
+		item.Subtotal = r.money()
+	}
+
+	o.Totals.Subtotal = r.money()
+	o.Totals.Discount = r.money()
+	o.Totals.TaxRate = uint(r.uint())
+	o.Totals.Tax = r.money()
+	o.Totals.Total = r.money()
+
+	if r.uint() == 1 {
+		o.ShippingAddress = &model.Address{
+			Name:       r.string(),
+			Line1:      r.string(),
+			Line2:      r.string(),
+			City:       r.string(),
+			Region:     r.string(),
+			PostalCode: r.string(),
+			Country:    r.string(),
+		}
+	}
+
+	if r.err != nil {
+		return r.err
+	}
+	*order = o
+	return nil
+}
+
+type binWriter struct {
+	buf []byte
+}
+
+func (w *binWriter) uint(n uint64) { w.buf = binary.AppendUvarint(w.buf, n) }
+func (w *binWriter) int(n int64)   { w.buf = binary.AppendVarint(w.buf, n) }
+
+func (w *binWriter) string(s string) {
+	w.uint(uint64(len(s)))
+	w.buf = append(w.buf, s...)
+}
+
+func (w *binWriter) uuid(id uuid.UUID) { w.buf = append(w.buf, id[:]...) }
+
+func (w *binWriter) money(m model.Money) {
+	w.int(m.Amount)
+	w.string(m.Currency)
+}
+
+// NOTE: Reading past the end sets err and returns zero values from then
+// on, so Unmarshal only has to check err once at the end
+type binReader struct {
+	data []byte
+	err  error
+}
+
+func (r *binReader) fail() {
+	if r.err == nil {
+		r.err = errTruncated
+	}
+	r.data = nil
+}
+
+func (r *binReader) uint() uint64 {
+	n, size := binary.Uvarint(r.data)
+	if size <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[size:]
+	return n
+}
+
+func (r *binReader) int() int64 {
+	n, size := binary.Varint(r.data)
+	if size <= 0 {
+		r.fail()
+		return 0
+	}
+	r.data = r.data[size:]
+	return n
+}
+
+func (r *binReader) string() string {
+	n := r.uint()
+	if n > uint64(len(r.data)) {
+		r.fail()
+		return ""
+	}
+	s := string(r.data[:n])
+	r.data = r.data[n:]
+	return s
+}
+
+func (r *binReader) uuid() uuid.UUID {
+	var id uuid.UUID
+	if len(r.data) < len(id) {
+		r.fail()
+		return id
+	}
+	copy(id[:], r.data)
+	r.data = r.data[len(id):]
+	return id
+}
+
+func (r *binReader) money() model.Money {
+	return model.Money{Amount: r.int(), Currency: r.string()}
+}
@@ -0,0 +1,109 @@
+// Package codec encodes orders for storage. Pick one with
+// application.Config.OrderCodec.
+//
+// Every value Encode writes starts with a Format byte naming the Codec
+// that wrote it, so Decode can read values written by any of them. That
+// lets the codec be changed without migrating the data first: old values
+// are still read fine, and get re-encoded the next time they're written.
+// Large values can be gzipped on top (see Compress).
+package codec
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+type Codec interface {
+	// The tag written in front of every value this Codec encodes
+	Format() Format
+	Marshal(order model.Order) ([]byte, error)
+	Unmarshal(data []byte, order *model.Order) error
+}
+
+// The first byte of an encoded value
+type Format byte
+
+const (
+	FormatJSON    Format = 'j'
+	FormatMsgpack Format = 'm'
+	FormatBinary  Format = 'b'
+)
+
+// NOTE: Values stored before codecs existed are plain JSON with no tag.
+// A JSON object always starts with '{', which isn't a Format, so they're
+// told apart by that.
+const legacyJSONStart = '{'
+
+var ErrUnknownCodec = errors.New("Unknown codec")
+
+// The codecs by the names used in Config
+var codecs = map[string]Codec{
+	"json":    JSON{},
+	"msgpack": Msgpack{},
+	"binary":  Binary{},
+}
+
+// ByName returns the codec called name ("json", "msgpack" or "binary")
+func ByName(name string) (Codec, error) {
+	c, ok := codecs[name]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrUnknownCodec, name)
+	}
+	return c, nil
+}
+
+func byFormat(format Format) (Codec, bool) {
+	for _, c := range codecs {
+		if c.Format() == format {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// Encode the order with c, tagged with c's Format
+func Encode(c Codec, order model.Order) ([]byte, error) {
+	data, err := c.Marshal(order)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode order: %w", err)
+	}
+	return append([]byte{byte(c.Format())}, data...), nil
+}
+
+// Decode a value written by Encode with any codec (and maybe gzipped by
+// Compress), or an untagged legacy JSON value
+func Decode(data []byte, order *model.Order) error {
+	if len(data) == 0 {
+		return errors.New("Failed to decode order: empty value")
+	}
+
+	if Format(data[0]) == FormatGzip {
+		inner, err := decompress(data[1:])
+		if err != nil {
+			return fmt.Errorf("Failed to decompress order: %w", err)
+		}
+		// NOTE: Compress never gzips twice, so neither do we
+		if len(inner) == 0 || Format(inner[0]) == FormatGzip {
+			return errors.New("Failed to decode order: bad compressed value")
+		}
+		data = inner
+	}
+
+	if data[0] == legacyJSONStart {
+		if err := (JSON{}).Unmarshal(data, order); err != nil {
+			return fmt.Errorf("Failed to decode order json: %w", err)
+		}
+		return nil
+	}
+
+	c, ok := byFormat(Format(data[0]))
+	if !ok {
+		return fmt.Errorf("Failed to decode order: unknown format %q", data[0])
+	}
+	if err := c.Unmarshal(data[1:], order); err != nil {
+		return fmt.Errorf("Failed to decode order (format %q): %w", data[0], err)
+	}
+	return nil
+}
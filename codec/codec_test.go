@@ -0,0 +1,363 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+var allCodecs = []Codec{JSON{}, Msgpack{}, Binary{}}
+
+// The name ByName knows c by
+func nameOf(c Codec) string {
+	for name, known := range codecs {
+		if known == c {
+			return name
+		}
+	}
+	return string(c.Format())
+}
+
+func ptr(t time.Time) *time.Time { return &t }
+
+func usd(amount int64) model.Money { return model.Money{Amount: amount, Currency: "USD"} }
+
+// An order using every field, with n line items
+func fullOrder(n int) model.Order {
+	at := time.Date(2024, 3, 1, 12, 30, 45, 123456789, time.UTC)
+	order := model.Order{
+		OrderID:    1<<63 + 12345,
+		CustomerID: uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8"),
+		// Long enough to need a str16 in MessagePack
+		Notes: strings.Repeat("leave by the door ", 20),
+		ShippingAddress: &model.Address{
+			Name:       "Ada Lovelace",
+			Line1:      "12 St James's Square",
+			City:       "London",
+			PostalCode: "SW1Y 4JH",
+			Country:    "GB",
+		},
+		Status:      model.StatusRefunded,
+		CreatedAt:   ptr(at),
+		PaidAt:      ptr(at.Add(time.Minute)),
+		ShippedAt:   ptr(at.Add(time.Hour)),
+		DeliveredAt: ptr(at.Add(48 * time.Hour)),
+		RefundedAt:  ptr(at.Add(72 * time.Hour)),
+		// Before 1970, so negative in both encodings
+		ReturnedAt: ptr(time.Date(1969, 7, 20, 20, 17, 0, 1, time.UTC)),
+		DeletedAt:  ptr(at.Add(96 * time.Hour)),
+		Totals: model.Totals{
+			Subtotal: usd(1 << 40),
+			Discount: usd(-150),
+			TaxRate:  825,
+			Tax:      usd(-40000),
+			Total:    usd(-1 << 35),
+		},
+		Revision: 70000,
+	}
+	for i := 0; i < n; i++ {
+		order.LineItems = append(order.LineItems, model.LineItem{
+			ItemID:   uuid.NewSHA1(uuid.NameSpaceOID, []byte(fmt.Sprint(i))),
+			Quantity: uint(i*37 + 1),
+			// Negative amounts of every integer size
+			Price:    usd(-int64(1) << (i % 63)),
+			Subtotal: model.Money{Amount: int64(i) * 1000, Currency: "EUR"},
+		})
+	}
+	return order
+}
+
+var roundTripCases = []struct {
+	name  string
+	order model.Order
+}{
+	// Nil timestamps, no line items and no address
+	{"empty", model.Order{Status: model.StatusPending}},
+	{"created only", model.Order{
+		OrderID:    1,
+		CustomerID: uuid.New(),
+		Status:     model.StatusPending,
+		CreatedAt:  ptr(time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)),
+		LineItems:  []model.LineItem{{ItemID: uuid.New(), Quantity: 1, Price: usd(-1)}},
+	}},
+	{"full", fullOrder(3)},
+	// More than fit in a fixarray
+	{"many items", fullOrder(100)},
+}
+
+func TestRoundTrip(t *testing.T) {
+	for _, c := range allCodecs {
+		for _, tc := range roundTripCases {
+			t.Run(nameOf(c)+"/"+tc.name, func(t *testing.T) {
+				data, err := Encode(c, tc.order)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if Format(data[0]) != c.Format() {
+					t.Fatalf("got format %q, want %q", data[0], c.Format())
+				}
+				assertDecodes(t, data, tc.order)
+			})
+		}
+	}
+}
+
+func TestRoundTripCompressed(t *testing.T) {
+	for _, c := range allCodecs {
+		for _, tc := range roundTripCases {
+			t.Run(nameOf(c)+"/"+tc.name, func(t *testing.T) {
+				data, err := Encode(c, tc.order)
+				if err != nil {
+					t.Fatal(err)
+				}
+				compressed, err := Compress(data, 0)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				// Small values can come out bigger, and are left alone
+				if Format(compressed[0]) == FormatGzip {
+					if len(compressed) >= len(data) {
+						t.Errorf("compressed to %d bytes from %d", len(compressed), len(data))
+					}
+				} else if !bytes.Equal(compressed, data) {
+					t.Error("value changed without being compressed")
+				}
+				if tc.name == "many items" && Format(compressed[0]) != FormatGzip {
+					t.Error("large value wasn't compressed")
+				}
+
+				assertDecodes(t, compressed, tc.order)
+			})
+		}
+	}
+}
+
+func TestCompressThreshold(t *testing.T) {
+	data, err := Encode(JSON{}, fullOrder(100))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := Compress(data, len(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Error("value at the threshold was compressed")
+	}
+
+	got, err = Compress(data, len(data)-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if Format(got[0]) != FormatGzip {
+		t.Error("value over the threshold wasn't compressed")
+	}
+
+	// Compressing twice is a no-op
+	again, err := Compress(got, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, got) {
+		t.Error("compressed value was compressed again")
+	}
+}
+
+func TestDecodeLegacyJSON(t *testing.T) {
+	legacy := `{"order_id":42,"customer_id":"6ba7b810-9dad-11d1-80b4-00c04fd430c8",` +
+		`"line_items":[{"item_id":"6ba7b811-9dad-11d1-80b4-00c04fd430c8","quantity":2,"price":150}],` +
+		`"created_at":"2023-09-01T10:00:00Z","paid_at":null,"shipped_at":null,"completed_at":null}`
+
+	var order model.Order
+	if err := Decode([]byte(legacy), &order); err != nil {
+		t.Fatal(err)
+	}
+
+	if order.OrderID != 42 {
+		t.Errorf("got order_id %d, want 42", order.OrderID)
+	}
+	if len(order.LineItems) != 1 || order.LineItems[0].Price != usd(150) {
+		t.Errorf("got line items %+v, want one priced 150 USD", order.LineItems)
+	}
+	if order.CreatedAt == nil || !order.CreatedAt.Equal(time.Date(2023, 9, 1, 10, 0, 0, 0, time.UTC)) {
+		t.Errorf("got created_at %v", order.CreatedAt)
+	}
+	if order.PaidAt != nil {
+		t.Errorf("got paid_at %v, want nil", order.PaidAt)
+	}
+
+	// Same as the JSON codec writes, just without the tag
+	current, err := json.Marshal(fullOrder(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertDecodes(t, current, fullOrder(2))
+}
+
+// MessagePack written by a newer version, with a field we don't know
+// about, still decodes
+func TestMsgpackSkipsUnknownFields(t *testing.T) {
+	order := model.Order{OrderID: 7, Status: model.StatusPending, Revision: 1}
+	data, err := Msgpack{}.Marshal(order)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// order_id, customer_id, revision, status, line_items and totals
+	if data[0] != 0x80|6 {
+		t.Fatalf("got map header 0x%02x, want 0x86", data[0])
+	}
+	data[0]++
+
+	w := mpWriter{buf: data}
+	w.string("extra")
+	w.arrayHeader(9)
+	w.buf = append(w.buf, mpNil, mpTrue, mpFalse)
+	w.int(-100)
+	w.int(-1 << 40)
+	w.string(strings.Repeat("x", 300))
+	w.buf = append(w.buf, mpFloat64, 0, 0, 0, 0, 0, 0, 0, 0)
+	w.buf = append(w.buf, mpFixExt1+2, 5, 1, 2, 3, 4) // fixext 4
+	w.mapHeader(1)
+	w.uint(1)
+	w.uuid(uuid.New())
+
+	var got model.Order
+	if err := (Msgpack{}).Unmarshal(w.buf, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, order) {
+		t.Errorf("got %+v, want %+v", got, order)
+	}
+}
+
+// Every prefix of a value is an error, never a partly filled in order
+func TestDecodeTruncated(t *testing.T) {
+	order := fullOrder(3)
+	for _, c := range allCodecs {
+		data, err := Encode(c, order)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < len(data); i++ {
+			var got model.Order
+			if err := Decode(data[:i], &got); err == nil {
+				t.Errorf("%s: decoded %d of %d bytes without an error", nameOf(c), i, len(data))
+				break
+			}
+		}
+	}
+}
+
+func TestDecodeUnknownFormat(t *testing.T) {
+	var order model.Order
+	if err := Decode([]byte("x123"), &order); err == nil {
+		t.Error("decoded an unknown format")
+	}
+	if err := Decode(nil, &order); err == nil {
+		t.Error("decoded an empty value")
+	}
+}
+
+func assertDecodes(t *testing.T, data []byte, want model.Order) {
+	t.Helper()
+
+	var got model.Order
+	if err := Decode(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("round trip changed the order\n got: %+v\nwant: %+v", got, want)
+	}
+}
+
+// A FindAll page's worth of orders, each with plenty of line items
+func benchmarkPage() []model.Order {
+	page := make([]model.Order, 50)
+	for i := range page {
+		page[i] = fullOrder(40)
+		page[i].OrderID = uint64(i + 1)
+	}
+	return page
+}
+
+func encodePage(b *testing.B, c Codec, page []model.Order, compress bool) [][]byte {
+	values := make([][]byte, len(page))
+	for i, order := range page {
+		data, err := Encode(c, order)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if compress {
+			if data, err = Compress(data, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+		values[i] = data
+	}
+	return values
+}
+
+// Compare how big a page of orders is, and how long it takes to decode,
+// with each codec, e.g.
+//
+//	go test ./codec -run '^$' -bench DecodePage -benchmem
+func BenchmarkDecodePage(b *testing.B) {
+	page := benchmarkPage()
+
+	for _, c := range allCodecs {
+		for _, compress := range []bool{false, true} {
+			name := nameOf(c)
+			if compress {
+				name += "/gzip"
+			}
+
+			b.Run(name, func(b *testing.B) {
+				values := encodePage(b, c, page, compress)
+				var size int
+				for _, value := range values {
+					size += len(value)
+				}
+
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					for _, value := range values {
+						var order model.Order
+						if err := Decode(value, &order); err != nil {
+							b.Fatal(err)
+						}
+					}
+				}
+				b.ReportMetric(float64(size), "bytes/page")
+			})
+		}
+	}
+}
+
+func BenchmarkEncodePage(b *testing.B) {
+	page := benchmarkPage()
+
+	for _, c := range allCodecs {
+		b.Run(nameOf(c), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, order := range page {
+					if _, err := Encode(c, order); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,70 @@
+package codec
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// The header byte of a gzipped value. What's inside is a value written
+// by Encode, with its own Format byte.
+const FormatGzip Format = 'z'
+
+// Decompressing stops here, so a corrupt (or malicious) value can't
+// expand into gigabytes. Far more than an order with MaxLineItems needs.
+const maxDecompressedSize = 16 << 20
+
+// NOTE: A gzip.Writer allocates a lot of state up front, so they're
+// reused rather than made for every write
+var gzipWriters = sync.Pool{
+	New: func() any { return gzip.NewWriter(nil) },
+}
+
+// Compress gzips a value written by Encode if it's longer than threshold
+// bytes. The value is returned as is if it's short enough, or if gzip
+// doesn't make it any smaller.
+func Compress(data []byte, threshold int) ([]byte, error) {
+	if len(data) <= threshold || Format(data[0]) == FormatGzip {
+		return data, nil
+	}
+
+	var buf bytes.Buffer
+	buf.Grow(len(data) / 2)
+	buf.WriteByte(byte(FormatGzip))
+
+	zw := gzipWriters.Get().(*gzip.Writer)
+	defer gzipWriters.Put(zw)
+	zw.Reset(&buf)
+	if _, err := zw.Write(data); err != nil {
+		return nil, fmt.Errorf("Failed to compress order: %w", err)
+	}
+	if err := zw.Close(); err != nil {
+		return nil, fmt.Errorf("Failed to compress order: %w", err)
+	}
+
+	if buf.Len() >= len(data) {
+		return data, nil
+	}
+	return buf.Bytes(), nil
+}
+
+// The value inside a gzipped one
+func decompress(data []byte) ([]byte, error) {
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+
+	inner, err := io.ReadAll(io.LimitReader(zr, maxDecompressedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(inner) > maxDecompressedSize {
+		return nil, errors.New("decompressed value is too large")
+	}
+	return inner, nil
+}
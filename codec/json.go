@@ -0,0 +1,22 @@
+package codec
+
+import (
+	"encoding/json"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+// JSON is the original encoding, the same JSON the API returns.
+// The easiest to read with redis-cli, but the largest and slowest.
+type JSON struct{}
+
+func (JSON) Format() Format { return FormatJSON }
+
+func (JSON) Marshal(order model.Order) ([]byte, error) {
+	return json.Marshal(order)
+}
+
+func (JSON) Unmarshal(data []byte, order *model.Order) error {
+	// NOTE: & seems to specify the 'pointer' of the value
+	return json.Unmarshal(data, order)
+}
@@ -0,0 +1,592 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+// Msgpack encodes the order as a MessagePack map with the same field
+// names as the JSON, so other MessagePack clients can read it. IDs are
+// stored as their 16 raw bytes and timestamps use the standard timestamp
+// extension, which makes it a good deal smaller than JSON.
+//
+// REF: https://github.com/msgpack/msgpack/blob/master/spec.md
+// NOTE: Only the parts of the spec an Order needs are implemented here,
+// rather than pulling in a whole MessagePack library.
+type Msgpack struct{}
+
+func (Msgpack) Format() Format { return FormatMsgpack }
+
+func (Msgpack) Marshal(order model.Order) ([]byte, error) {
+	w := mpWriter{buf: make([]byte, 0, 256+128*len(order.LineItems))}
+
+	// Nil timestamps and empty optional fields are left out
+	times := timestamps(&order)
+	n := 6
+	for _, t := range times {
+		if *t != nil {
+			n++
+		}
+	}
+	if order.Notes != "" {
+		n++
+	}
+	if order.ShippingAddress != nil {
+		n++
+	}
+
+	w.mapHeader(n)
+	w.string("order_id")
+	w.uint(order.OrderID)
+	w.string("customer_id")
+	w.uuid(order.CustomerID)
+	w.string("revision")
+	w.uint(order.Revision)
+	w.string("status")
+	w.string(string(order.Status))
+	if order.Notes != "" {
+		w.string("notes")
+		w.string(order.Notes)
+	}
+	for i, t := range times {
+		if *t != nil {
+			w.string(timestampNames[i])
+			w.time(**t)
+		}
+	}
+
+	w.string("line_items")
+	w.arrayHeader(len(order.LineItems))
+	for _, item := range order.LineItems {
+		w.mapHeader(4)
+		w.string("item_id")
+		w.uuid(item.ItemID)
+		w.string("quantity")
+		w.uint(uint64(item.Quantity))
+		w.string("price")
+		w.money(item.Price)
+		w.string("subtotal")
+		w.money(item.Subtotal)
+	}
+
+	w.string("totals")
+	w.mapHeader(5)
+	w.string("subtotal")
+	w.money(order.Totals.Subtotal)
+	w.string("discount")
+	w.money(order.Totals.Discount)
+	w.string("tax_rate_bps")
+	w.uint(uint64(order.Totals.TaxRate))
+	w.string("tax")
+	w.money(order.Totals.Tax)
+	w.string("total")
+	w.money(order.Totals.Total)
+
+	if a := order.ShippingAddress; a != nil {
+		w.string("shipping_address")
+		w.mapHeader(7)
+		w.string("name")
+		w.string(a.Name)
+		w.string("line1")
+		w.string(a.Line1)
+		w.string("line2")
+		w.string(a.Line2)
+		w.string("city")
+		w.string(a.City)
+		w.string("region")
+		w.string(a.Region)
+		w.string("postal_code")
+		w.string(a.PostalCode)
+		w.string("country")
+		w.string(a.Country)
+	}
+
+	return w.buf, nil
+}
+
+func (Msgpack) Unmarshal(data []byte, order *model.Order) error {
+	r := mpReader{data: data}
+	var o model.Order
+
+	times := make(map[string]**time.Time, len(timestampNames))
+	for i, t := range timestamps(&o) {
+		times[timestampNames[i]] = t
+	}
+
+	r.mapEntries(func(key string) {
+		if t, ok := times[key]; ok {
+			at := r.time()
+			*t = &at
+			return
+		}
+
+		switch key {
+		case "order_id":
+			o.OrderID = r.uint()
+		case "customer_id":
+			o.CustomerID = r.uuid()
+		case "revision":
+			o.Revision = r.uint()
+		case "status":
+			o.Status = model.Status(r.string())
+		case "notes":
+			o.Notes = r.string()
+		case "line_items":
+			n := r.arrayHeader()
+			// NOTE: Each item takes at least 4 bytes, so a bigger count
+			// than that is a corrupt value, not something to allocate
+			if n > len(r.data)/4 {
+				r.fail(errTruncated)
+				return
+			}
+			if n > 0 {
+				o.LineItems = make([]model.LineItem, n)
+			}
+			for i := range o.LineItems {
+				o.LineItems[i] = r.lineItem()
+			}
+		case "totals":
+			o.Totals = r.totals()
+		case "shipping_address":
+			o.ShippingAddress = r.address()
+		default:
+			// Written by a newer version, skip it
+			r.skip()
+		}
+	})
+
+	if r.err != nil {
+		return r.err
+	}
+	*order = o
+	return nil
+}
+
+// The MessagePack type bytes used here
+const (
+	mpNil       = 0xc0
+	mpFalse     = 0xc2
+	mpTrue      = 0xc3
+	mpBin8      = 0xc4
+	mpBin16     = 0xc5
+	mpBin32     = 0xc6
+	mpExt8      = 0xc7
+	mpExt16     = 0xc8
+	mpExt32     = 0xc9
+	mpFloat32   = 0xca
+	mpFloat64   = 0xcb
+	mpUint8     = 0xcc
+	mpUint16    = 0xcd
+	mpUint32    = 0xce
+	mpUint64    = 0xcf
+	mpInt8      = 0xd0
+	mpInt16     = 0xd1
+	mpInt32     = 0xd2
+	mpInt64     = 0xd3
+	mpFixExt1   = 0xd4
+	mpFixExt16  = 0xd8
+	mpStr8      = 0xd9
+	mpStr16     = 0xda
+	mpStr32     = 0xdb
+	mpArray16   = 0xdc
+	mpArray32   = 0xdd
+	mpMap16     = 0xde
+	mpMap32     = 0xdf
+	mpTimestamp = -1 // The ext type of timestamps
+)
+
+type mpWriter struct {
+	buf []byte
+}
+
+// Write a type byte followed by n as a big-endian number of size bytes
+func (w *mpWriter) sized(typ byte, n uint64, size int) {
+	w.buf = append(w.buf, typ)
+	for i := size - 1; i >= 0; i-- {
+		w.buf = append(w.buf, byte(n>>(8*i)))
+	}
+}
+
+// Write a length for the fixed/16/32 bit families (str, array, map)
+func (w *mpWriter) length(n int, fixed byte, fixedMax int, typ16, typ32 byte) {
+	switch {
+	case n <= fixedMax:
+		w.buf = append(w.buf, fixed|byte(n))
+	case n <= math.MaxUint16:
+		w.sized(typ16, uint64(n), 2)
+	default:
+		w.sized(typ32, uint64(n), 4)
+	}
+}
+
+func (w *mpWriter) mapHeader(n int)   { w.length(n, 0x80, 15, mpMap16, mpMap32) }
+func (w *mpWriter) arrayHeader(n int) { w.length(n, 0x90, 15, mpArray16, mpArray32) }
+
+func (w *mpWriter) string(s string) {
+	if len(s) > 31 && len(s) <= math.MaxUint8 {
+		w.sized(mpStr8, uint64(len(s)), 1)
+	} else {
+		w.length(len(s), 0xa0, 31, mpStr16, mpStr32)
+	}
+	w.buf = append(w.buf, s...)
+}
+
+func (w *mpWriter) uint(n uint64) {
+	switch {
+	case n <= 0x7f:
+		w.buf = append(w.buf, byte(n))
+	case n <= math.MaxUint8:
+		w.sized(mpUint8, n, 1)
+	case n <= math.MaxUint16:
+		w.sized(mpUint16, n, 2)
+	case n <= math.MaxUint32:
+		w.sized(mpUint32, n, 4)
+	default:
+		w.sized(mpUint64, n, 8)
+	}
+}
+
+func (w *mpWriter) int(n int64) {
+	switch {
+	case n >= 0:
+		w.uint(uint64(n))
+	case n >= -32:
+		w.buf = append(w.buf, byte(n))
+	case n >= math.MinInt8:
+		w.sized(mpInt8, uint64(n), 1)
+	case n >= math.MinInt16:
+		w.sized(mpInt16, uint64(n), 2)
+	case n >= math.MinInt32:
+		w.sized(mpInt32, uint64(n), 4)
+	default:
+		w.sized(mpInt64, uint64(n), 8)
+	}
+}
+
+func (w *mpWriter) uuid(id uuid.UUID) {
+	w.sized(mpBin8, uint64(len(id)), 1)
+	w.buf = append(w.buf, id[:]...)
+}
+
+// Always the 96-bit timestamp format, which fits any time
+func (w *mpWriter) time(t time.Time) {
+	w.buf = append(w.buf, mpExt8, 12, byte(0xff&mpTimestamp))
+	w.buf = binary.BigEndian.AppendUint32(w.buf, uint32(t.Nanosecond()))
+	w.buf = binary.BigEndian.AppendUint64(w.buf, uint64(t.Unix()))
+}
+
+func (w *mpWriter) money(m model.Money) {
+	w.mapHeader(2)
+	w.string("amount")
+	w.int(m.Amount)
+	w.string("currency")
+	w.string(m.Currency)
+}
+
+// NOTE: Like binReader, the first error sticks and everything read after
+// it comes back as zero values
+type mpReader struct {
+	data []byte
+	err  error
+}
+
+func (r *mpReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+	r.data = nil
+}
+
+func (r *mpReader) next(n int) []byte {
+	if n < 0 || n > len(r.data) {
+		r.fail(errTruncated)
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *mpReader) byte() byte {
+	b := r.next(1)
+	if b == nil {
+		return 0
+	}
+	return b[0]
+}
+
+// Read a big-endian number of size bytes
+func (r *mpReader) sized(size int) uint64 {
+	var n uint64
+	for _, b := range r.next(size) {
+		n = n<<8 | uint64(b)
+	}
+	return n
+}
+
+func (r *mpReader) wrongType(want string, typ byte) {
+	r.fail(fmt.Errorf("wrong type: want %s, got 0x%02x", want, typ))
+}
+
+func (r *mpReader) mapHeader() int {
+	switch typ := r.byte(); {
+	case typ&0xf0 == 0x80:
+		return int(typ & 0x0f)
+	case typ == mpMap16:
+		return int(r.sized(2))
+	case typ == mpMap32:
+		return int(r.sized(4))
+	default:
+		r.wrongType("map", typ)
+		return 0
+	}
+}
+
+func (r *mpReader) arrayHeader() int {
+	switch typ := r.byte(); {
+	case typ&0xf0 == 0x90:
+		return int(typ & 0x0f)
+	case typ == mpArray16:
+		return int(r.sized(2))
+	case typ == mpArray32:
+		return int(r.sized(4))
+	case typ == mpNil:
+		return 0
+	default:
+		r.wrongType("array", typ)
+		return 0
+	}
+}
+
+// Call fn for each key of a map, which must read (or skip) its value
+func (r *mpReader) mapEntries(fn func(key string)) {
+	n := r.mapHeader()
+	for i := 0; i < n && r.err == nil; i++ {
+		fn(r.string())
+	}
+}
+
+func (r *mpReader) string() string {
+	var n int
+	switch typ := r.byte(); {
+	case typ&0xe0 == 0xa0:
+		n = int(typ & 0x1f)
+	case typ == mpStr8:
+		n = int(r.sized(1))
+	case typ == mpStr16:
+		n = int(r.sized(2))
+	case typ == mpStr32:
+		n = int(r.sized(4))
+	default:
+		r.wrongType("string", typ)
+		return ""
+	}
+	return string(r.next(n))
+}
+
+func (r *mpReader) uint() uint64 {
+	switch typ := r.byte(); {
+	case typ <= 0x7f:
+		return uint64(typ)
+	case typ == mpUint8:
+		return r.sized(1)
+	case typ == mpUint16:
+		return r.sized(2)
+	case typ == mpUint32:
+		return r.sized(4)
+	case typ == mpUint64:
+		return r.sized(8)
+	default:
+		r.wrongType("unsigned integer", typ)
+		return 0
+	}
+}
+
+func (r *mpReader) int() int64 {
+	// Positive numbers are written as unsigned
+	if len(r.data) == 0 || (r.data[0] < 0xe0 && (r.data[0] < mpInt8 || r.data[0] > mpInt64)) {
+		return int64(r.uint())
+	}
+
+	switch typ := r.byte(); typ {
+	case mpInt8:
+		return int64(int8(r.sized(1)))
+	case mpInt16:
+		return int64(int16(r.sized(2)))
+	case mpInt32:
+		return int64(int32(r.sized(4)))
+	case mpInt64:
+		return int64(r.sized(8))
+	default:
+		// Negative fixint
+		return int64(int8(typ))
+	}
+}
+
+func (r *mpReader) uuid() uuid.UUID {
+	var id uuid.UUID
+	if typ := r.byte(); typ != mpBin8 {
+		r.wrongType("bin", typ)
+		return id
+	}
+	if n := int(r.sized(1)); n != len(id) {
+		r.fail(fmt.Errorf("wrong id length %d", n))
+		return id
+	}
+	copy(id[:], r.next(len(id)))
+	return id
+}
+
+func (r *mpReader) time() time.Time {
+	if typ := r.byte(); typ != mpExt8 {
+		r.wrongType("timestamp", typ)
+		return time.Time{}
+	}
+	if n, ext := r.byte(), int8(r.byte()); n != 12 || ext != mpTimestamp {
+		r.fail(errors.New("unsupported timestamp format"))
+		return time.Time{}
+	}
+	nsec := r.sized(4)
+	sec := int64(r.sized(8))
+	return time.Unix(sec, int64(nsec)).UTC()
+}
+
+func (r *mpReader) money() model.Money {
+	var m model.Money
+	r.mapEntries(func(key string) {
+		switch key {
+		case "amount":
+			m.Amount = r.int()
+		case "currency":
+			m.Currency = r.string()
+		default:
+			r.skip()
+		}
+	})
+	return m
+}
+
+func (r *mpReader) lineItem() model.LineItem {
+	var item model.LineItem
+	r.mapEntries(func(key string) {
+		switch key {
+		case "item_id":
+			item.ItemID = r.uuid()
+		case "quantity":
+			item.Quantity = uint(r.uint())
+		case "price":
+			item.Price = r.money()
+		case "subtotal":
+			item.Subtotal = r.money()
+		default:
+			r.skip()
+		}
+	})
+	return item
+}
+
+func (r *mpReader) totals() model.Totals {
+	var totals model.Totals
+	r.mapEntries(func(key string) {
+		switch key {
+		case "subtotal":
+			totals.Subtotal = r.money()
+		case "discount":
+			totals.Discount = r.money()
+		case "tax_rate_bps":
+			totals.TaxRate = uint(r.uint())
+		case "tax":
+			totals.Tax = r.money()
+		case "total":
+			totals.Total = r.money()
+		default:
+			r.skip()
+		}
+	})
+	return totals
+}
+
+func (r *mpReader) address() *model.Address {
+	var a model.Address
+	fields := map[string]*string{
+		"name":        &a.Name,
+		"line1":       &a.Line1,
+		"line2":       &a.Line2,
+		"city":        &a.City,
+		"region":      &a.Region,
+		"postal_code": &a.PostalCode,
+		"country":     &a.Country,
+	}
+	r.mapEntries(func(key string) {
+		if field, ok := fields[key]; ok {
+			*field = r.string()
+		} else {
+			r.skip()
+		}
+	})
+	return &a
+}
+
+// Skip over one value of any type
+func (r *mpReader) skip() {
+	typ := r.byte()
+	switch {
+	case r.err != nil:
+	case typ <= 0x7f, typ >= 0xe0, typ == mpNil, typ == mpFalse, typ == mpTrue:
+	case typ&0xe0 == 0xa0:
+		r.next(int(typ & 0x1f))
+	case typ&0xf0 == 0x80:
+		for n := int(typ&0x0f) * 2; n > 0 && r.err == nil; n-- {
+			r.skip()
+		}
+	case typ&0xf0 == 0x90:
+		for n := int(typ & 0x0f); n > 0 && r.err == nil; n-- {
+			r.skip()
+		}
+	case typ == mpBin8, typ == mpStr8:
+		r.next(int(r.sized(1)))
+	case typ == mpBin16, typ == mpStr16:
+		r.next(int(r.sized(2)))
+	case typ == mpBin32, typ == mpStr32:
+		r.next(int(r.sized(4)))
+	case typ == mpExt8:
+		r.next(int(r.sized(1)) + 1)
+	case typ == mpExt16:
+		r.next(int(r.sized(2)) + 1)
+	case typ == mpExt32:
+		r.next(int(r.sized(4)) + 1)
+	case typ == mpFloat32, typ == mpUint32, typ == mpInt32:
+		r.next(4)
+	case typ == mpFloat64, typ == mpUint64, typ == mpInt64:
+		r.next(8)
+	case typ == mpUint8, typ == mpInt8:
+		r.next(1)
+	case typ == mpUint16, typ == mpInt16:
+		r.next(2)
+	case typ >= mpFixExt1 && typ <= mpFixExt16:
+		// 1, 2, 4, 8 or 16 bytes of data after the ext type
+		r.next(1<<(typ-mpFixExt1) + 1)
+	case typ == mpArray16, typ == mpArray32, typ == mpMap16, typ == mpMap32:
+		var n int
+		if typ == mpArray16 || typ == mpMap16 {
+			n = int(r.sized(2))
+		} else {
+			n = int(r.sized(4))
+		}
+		if typ == mpMap16 || typ == mpMap32 {
+			n *= 2
+		}
+		for ; n > 0 && r.err == nil; n-- {
+			r.skip()
+		}
+	default:
+		r.fail(fmt.Errorf("unknown type 0x%02x", typ))
+	}
+}
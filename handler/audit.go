@@ -0,0 +1,27 @@
+package handler
+
+import (
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+
+	"github.com/gaylonalfano/go-redis-crud/repository/order"
+)
+
+// Header clients use to say who's making a change, e.g. a user or
+// service name. Recorded in each order's history.
+const actorHeader = "X-Actor"
+
+// AuditContext stores who is making the request (and chi's request ID)
+// in the request Context, so the repository can record it in the history
+// of every order the request changes.
+// NOTE: Must run after middleware.RequestID
+func AuditContext(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := order.WithAuditInfo(r.Context(), order.AuditInfo{
+			Actor:     r.Header.Get(actorHeader),
+			RequestID: middleware.GetReqID(r.Context()),
+		})
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
@@ -0,0 +1,199 @@
+package handler
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+	"github.com/gaylonalfano/go-redis-crud/repository/order"
+)
+
+const (
+	// Most orders we'll accept in a single batch request
+	maxBatchSize = 1000
+	// Largest batch request body we'll read. Exported so middleware that
+	// reads the body first (e.g. idempotency) can use the same limit
+	MaxBatchBytes = 10 << 20
+)
+
+// One entry in the CreateBatch response, in the same position as the
+// create body it's for
+type batchResult struct {
+	Index  int          `json:"index"`
+	Status int          `json:"status"`
+	Order  *model.Order `json:"order,omitempty"`
+	Error  string       `json:"error,omitempty"`
+}
+
+// Record why the item failed, with the status we'd have sent for it alone
+func (res *batchResult) fail(err error) {
+	p := problemFor(err)
+	res.Status = p.Status
+	res.Error = p.Error()
+}
+
+// CreateBatch creates many orders in one request. The body is either a
+// JSON array of create bodies or, with Content-Type application/x-ndjson,
+// one create body per line. With ?atomic=true either every order is
+// created or none are.
+func (h *Order) CreateBatch(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Create a batch of orders")
+
+	atomic := false
+	if s := r.URL.Query().Get("atomic"); s != "" {
+		var err error
+		atomic, err = strconv.ParseBool(s)
+		if err != nil {
+			writeError(w, r, invalidField("atomic", "must be true or false"))
+			return
+		}
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBatchBytes)
+
+	items, err := readBatch(r)
+	if err != nil {
+		// Too large is a 413, anything else is the client's bad JSON
+		var maxBytesErr *http.MaxBytesError
+		if !errors.As(err, &maxBytesErr) {
+			err = invalidRequest(err.Error())
+		}
+		writeError(w, r, err)
+		return
+	}
+	if len(items) == 0 || len(items) > maxBatchSize {
+		writeError(w, r, invalidRequest(fmt.Sprintf("Batch must contain 1 to %d orders", maxBatchSize)))
+		return
+	}
+
+	// Decode and validate each item on its own, so one bad order doesn't
+	// stop us reporting on the rest
+	results := make([]batchResult, len(items))
+	orders := make([]model.Order, 0, len(items))
+	positions := make([]int, 0, len(items)) // index of each order in results
+	// NOTE: The whole batch shares one CreatedAt, so the created-order
+	// indexes sort it by OrderID, which we hand out in body order. Paging
+	// cursors resume inside a group of equal CreatedAts, so a batch bigger
+	// than a page doesn't cut the listing short.
+	now := time.Now().UTC()
+
+	for i, item := range items {
+		results[i].Index = i
+
+		var body createOrderBody
+		if err := decodeJSON(bytes.NewReader(item), &body); err != nil {
+			results[i].fail(err)
+			continue
+		}
+		if err := body.validate(); err != nil {
+			results[i].fail(err)
+			continue
+		}
+
+		o, err := body.newOrder(now, h.TaxRate)
+		if err != nil {
+			results[i].fail(err)
+			continue
+		}
+		o.OrderID, err = h.IDs.NextID(r.Context())
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+
+		orders = append(orders, o)
+		positions = append(positions, i)
+	}
+
+	failed := len(orders) < len(items)
+
+	// In atomic mode a single invalid order means we insert nothing
+	var errs []error
+	if atomic && failed {
+		errs = make([]error, len(orders))
+		for i := range errs {
+			errs[i] = order.ErrBatchAborted
+		}
+	} else if len(orders) > 0 {
+		errs, err = h.Repo.InsertMany(r.Context(), orders, atomic)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	for j, i := range positions {
+		if errs[j] != nil {
+			results[i].fail(errs[j])
+			failed = true
+			continue
+		}
+		results[i].Status = http.StatusCreated
+		results[i].Order = &orders[j]
+	}
+
+	var response struct {
+		Results []batchResult `json:"results"`
+	}
+	response.Results = results
+
+	// Per-item statuses carry the details. An atomic batch that was rolled
+	// back as a whole is a failed request though.
+	status := http.StatusOK
+	if atomic && failed {
+		status = http.StatusUnprocessableEntity
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Println("Failed to marshal:", err)
+	}
+}
+
+// Split the request body into one raw JSON document per order
+func readBatch(r *http.Request) ([]json.RawMessage, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+
+	if mediaType != "application/x-ndjson" {
+		var items []json.RawMessage
+		dec := json.NewDecoder(r.Body)
+		if err := dec.Decode(&items); err != nil {
+			return nil, fmt.Errorf("Body must be a JSON array of orders: %w", err)
+		}
+		// Same as decodeJSON, anything after the array is an error
+		if _, err := dec.Token(); err != io.EOF {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return nil, err
+			}
+			return nil, errors.New("Body must contain a single JSON array of orders")
+		}
+		return items, nil
+	}
+
+	// NDJSON: one JSON document per line, blank lines ignored
+	var items []json.RawMessage
+	scanner := bufio.NewScanner(r.Body)
+	scanner.Buffer(make([]byte, 64*1024), MaxBatchBytes)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		items = append(items, append(json.RawMessage(nil), line...))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("Failed to read NDJSON body: %w", err)
+	}
+
+	return items, nil
+}
@@ -0,0 +1,92 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+// One entry in the BulkStatus response, in the same position as the order
+// ID it's for
+type bulkStatusResult struct {
+	OrderID uint64       `json:"order_id"`
+	Status  int          `json:"status"`
+	Order   *model.Order `json:"order,omitempty"`
+	Error   string       `json:"error,omitempty"`
+}
+
+// BulkStatus moves many orders to the same status in one request, e.g.
+// marking a day's worth of orders as shipped. Each order goes through the
+// same state machine as UpdateByID and gets its own result, so orders that
+// can't make the transition don't stop the rest.
+func (h *Order) BulkStatus(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Update the status of many orders")
+
+	var body struct {
+		OrderIDs []uint64 `json:"order_ids"`
+		Status   string   `json:"status"`
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, MaxBatchBytes)
+	if err := decodeJSON(r.Body, &body); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// Unknown statuses can be rejected before we touch the repo
+	status := model.Status(body.Status)
+	if !status.Valid() {
+		writeError(w, r, invalidField("status", fmt.Sprintf("%q is not an order status", body.Status)))
+		return
+	}
+
+	// Listing an order twice doesn't mean transition it twice
+	ids := make([]uint64, 0, len(body.OrderIDs))
+	seen := make(map[uint64]bool, len(body.OrderIDs))
+	for _, id := range body.OrderIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxBatchSize {
+		writeError(w, r, invalidField("order_ids", fmt.Sprintf("must contain 1 to %d orders", maxBatchSize)))
+		return
+	}
+
+	now := time.Now().UTC()
+	updates, err := h.Repo.UpdateMany(r.Context(), ids, func(currentOrder *model.Order) error {
+		return currentOrder.Transition(status, now)
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	results := make([]bulkStatusResult, len(ids))
+	for i, update := range updates {
+		results[i].OrderID = ids[i]
+
+		if update.Err != nil {
+			p := problemFor(update.Err)
+			results[i].Status = p.Status
+			results[i].Error = p.Error()
+			continue
+		}
+		results[i].Status = http.StatusOK
+		results[i].Order = &updates[i].Order
+	}
+
+	var response struct {
+		Results []bulkStatusResult `json:"results"`
+	}
+	response.Results = results
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Println("Failed to marshal:", err)
+	}
+}
@@ -0,0 +1,55 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gaylonalfano/go-redis-crud/repository/order"
+)
+
+// Cookie holding when the client last wrote something, in Unix
+// milliseconds
+const lastWriteCookie = "last_write"
+
+// ReadYourWrites lets the repository send a client's reads to the primary
+// for a while after it writes something, so it always sees its own
+// changes even when reads normally go to a lagging replica (see
+// order.ReadYourWrites). Every request that might write (anything but
+// GET, HEAD and OPTIONS) sets a cookie that lasts for window, and requests
+// sending it back get its time put in their Context.
+func ReadYourWrites(window time.Duration) func(http.Handler) http.Handler {
+	maxAge := int(math.Ceil(window.Seconds()))
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx := r.Context()
+			if cookie, err := r.Cookie(lastWriteCookie); err == nil {
+				if ms, err := strconv.ParseInt(cookie.Value, 10, 64); err == nil {
+					ctx = order.WithLastWrite(ctx, time.UnixMilli(ms))
+				}
+			}
+
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				// NOTE: Set before the handler runs, since headers can't be
+				// added once it starts writing the response. A failed write
+				// just means a few reads go to the primary for nothing.
+				now := time.Now()
+				http.SetCookie(w, &http.Cookie{
+					Name:     lastWriteCookie,
+					Value:    strconv.FormatInt(now.UnixMilli(), 10),
+					Path:     "/",
+					MaxAge:   maxAge,
+					HttpOnly: true,
+					SameSite: http.SameSiteLaxMode,
+				})
+				ctx = order.WithLastWrite(ctx, now)
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
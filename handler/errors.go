@@ -0,0 +1,157 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+	"github.com/gaylonalfano/go-redis-crud/problem"
+	"github.com/gaylonalfano/go-redis-crud/repository/order"
+)
+
+// Problem types clients can act on. The URIs only need to be unique and
+// stable, nothing is served at them.
+const (
+	problemInvalidRequest    = "/problems/invalid-request"
+	problemNotFound          = "/problems/not-found"
+	problemAlreadyExists     = "/problems/already-exists"
+	problemInvalidTransition = "/problems/invalid-status-transition"
+	problemRevisionMismatch  = "/problems/revision-mismatch"
+	problemConflict          = "/problems/conflict"
+	problemBatchAborted      = "/problems/batch-aborted"
+	problemItemsLocked       = "/problems/line-items-locked"
+	problemNotDeleted        = "/problems/not-deleted"
+)
+
+// A 400 for a request that's malformed as a whole, e.g. a body that
+// isn't JSON
+func invalidRequest(detail string) *problem.Problem {
+	return &problem.Problem{
+		Type:   problemInvalidRequest,
+		Title:  "Invalid request",
+		Status: http.StatusBadRequest,
+		Detail: detail,
+	}
+}
+
+// A 400 for one bad field, header or query parameter of the request
+func invalidField(field, message string) *problem.Problem {
+	p := invalidRequest(field + " " + message)
+	p.Errors = []problem.FieldError{{Field: field, Message: message}}
+	return p
+}
+
+// U: Central mapping from the errors handlers run into (mostly from the
+// repository) to what we tell the client, instead of an errors.Is chain
+// in every handler.
+func problemFor(err error) *problem.Problem {
+	var p *problem.Problem
+	var validationErr model.ValidationError
+	var transitionErr *model.TransitionError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &p):
+		return p
+	case errors.Is(err, model.ErrLineItemNotExist):
+		return &problem.Problem{
+			Type:   problemNotFound,
+			Title:  "Line item not found",
+			Status: http.StatusNotFound,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, model.ErrLineItemExists):
+		return &problem.Problem{
+			Type:   problemAlreadyExists,
+			Title:  "Line item already exists",
+			Status: http.StatusConflict,
+			Detail: "The order already has this item, change its quantity instead",
+		}
+	case errors.Is(err, model.ErrItemsLocked):
+		return &problem.Problem{
+			Type:   problemItemsLocked,
+			Title:  "Line items locked",
+			Status: http.StatusConflict,
+			Detail: err.Error(),
+		}
+	case errors.As(err, &validationErr):
+		p := invalidRequest(err.Error())
+		for _, fe := range validationErr {
+			p.Errors = append(p.Errors, problem.FieldError{Field: fe.Field, Message: fe.Message})
+		}
+		return p
+	case errors.Is(err, model.ErrCurrencyMismatch):
+		return invalidRequest(err.Error())
+	case errors.As(err, &maxBytesErr):
+		return problem.New(http.StatusRequestEntityTooLarge, fmt.Sprintf("Body must be at most %d bytes", maxBytesErr.Limit))
+	case errors.Is(err, order.ErrNotExist):
+		return &problem.Problem{
+			Type:   problemNotFound,
+			Title:  "Order not found",
+			Status: http.StatusNotFound,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, order.ErrAlreadyExists):
+		return &problem.Problem{
+			Type:   problemAlreadyExists,
+			Title:  "Order already exists",
+			Status: http.StatusConflict,
+			Detail: err.Error(),
+		}
+	case errors.As(err, &transitionErr):
+		// The detail tells the client which statuses it could have asked for
+		return &problem.Problem{
+			Type:   problemInvalidTransition,
+			Title:  "Illegal status transition",
+			Status: http.StatusBadRequest,
+			Detail: err.Error(),
+			Errors: []problem.FieldError{{Field: "status", Message: err.Error()}},
+		}
+	case errors.Is(err, order.ErrNotDeleted):
+		return &problem.Problem{
+			Type:   problemNotDeleted,
+			Title:  "Order is not deleted",
+			Status: http.StatusConflict,
+			Detail: "Only orders in the trash can be restored or purged",
+		}
+	case errors.Is(err, order.ErrRevisionMismatch):
+		return &problem.Problem{
+			Type:   problemRevisionMismatch,
+			Title:  "Order has changed",
+			Status: http.StatusPreconditionFailed,
+			Detail: "The order's current revision doesn't match If-Match",
+		}
+	case errors.Is(err, order.ErrConflict):
+		// Lost the race to other updates too many times
+		return &problem.Problem{
+			Type:   problemConflict,
+			Title:  "Concurrent update",
+			Status: http.StatusConflict,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, order.ErrBatchAborted):
+		return &problem.Problem{
+			Type:   problemBatchAborted,
+			Title:  "Batch aborted",
+			Status: http.StatusConflict,
+			Detail: err.Error(),
+		}
+	case errors.Is(err, order.ErrInvalidCursor):
+		return invalidField("cursor", "is not a cursor from a previous page")
+	case errors.Is(err, order.ErrUnsupportedFilter):
+		return invalidRequest(err.Error())
+	default:
+		// NOTE: Don't leak internal errors (e.g. Redis addresses) to clients
+		return problem.New(http.StatusInternalServerError, "")
+	}
+}
+
+// Write err to the client as a problem, logging anything that's our fault
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	p := problemFor(err)
+	if p.Status >= http.StatusInternalServerError {
+		fmt.Println("Failed to handle", r.Method, r.URL.Path+":", err)
+	}
+	problem.Write(w, r, p)
+}
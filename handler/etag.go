@@ -0,0 +1,104 @@
+package handler
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gaylonalfano/go-redis-crud/repository/order"
+)
+
+// An order's ETag is just its revision in quotes, e.g. "3"
+func formatETag(revision uint64) string {
+	return strconv.Quote(strconv.FormatUint(revision, 10))
+}
+
+// Parse a strong ETag back into a revision. Weak (W/"...") tags can't be
+// used for If-Match, so they never parse.
+func parseETag(etag string) (uint64, bool) {
+	etag = strings.TrimSpace(etag)
+	if len(etag) < 2 || etag[0] != '"' || etag[len(etag)-1] != '"' {
+		return 0, false
+	}
+
+	revision, err := strconv.ParseUint(etag[1:len(etag)-1], 10, 64)
+	if err != nil {
+		return 0, false
+	}
+
+	return revision, true
+}
+
+// Most ETags we'll try from one If-Match header
+const maxIfMatchTags = 10
+
+// Read the If-Match header into the revisions the repository should check.
+// Returns just order.AnyRevision when there's no header (or it's "*"),
+// and no revisions when nothing in it can possibly match.
+func ifMatchRevisions(r *http.Request) ([]uint64, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" || header == "*" {
+		return []uint64{order.AnyRevision}, nil
+	}
+
+	var revisions []uint64
+	for _, etag := range strings.Split(header, ",") {
+		// If-Match uses strong comparison, so a W/ tag never matches
+		// (and parseETag won't parse one)
+		rev, ok := parseETag(etag)
+		if !ok || slices.Contains(revisions, rev) {
+			continue
+		}
+		revisions = append(revisions, rev)
+	}
+	if len(revisions) > maxIfMatchTags {
+		return nil, invalidRequest(fmt.Sprintf("If-Match can list at most %d ETags", maxIfMatchTags))
+	}
+
+	return revisions, nil
+}
+
+// Run fn, which passes ifRevision on to the repository, with each revision
+// the If-Match header allows until one isn't a mismatch. The repository
+// checks the revision atomically, so only the current one can get through.
+// Returns order.ErrRevisionMismatch when none of them match.
+func ifMatch(r *http.Request, fn func(ifRevision uint64) error) error {
+	revisions, err := ifMatchRevisions(r)
+	if err != nil {
+		return err
+	}
+
+	err = order.ErrRevisionMismatch
+	for _, rev := range revisions {
+		err = fn(rev)
+		if !errors.Is(err, order.ErrRevisionMismatch) {
+			return err
+		}
+	}
+	return err
+}
+
+// Check whether any of the If-None-Match ETags is the current revision,
+// in which case the client's copy is still fresh
+func noneMatch(r *http.Request, revision uint64) bool {
+	header := strings.TrimSpace(r.Header.Get("If-None-Match"))
+	if header == "" {
+		return false
+	}
+	if header == "*" {
+		return true
+	}
+
+	for _, etag := range strings.Split(header, ",") {
+		// If-None-Match uses weak comparison, so ignore any W/ prefix
+		etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+		if rev, ok := parseETag(etag); ok && rev == revision {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,119 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+	"github.com/gaylonalfano/go-redis-crud/repository/order"
+)
+
+const (
+	// How long each read of the event stream waits for new events. Also
+	// bounds how long a closed connection can go unnoticed.
+	sseBlock = 2 * time.Second
+	// How often we send a comment line on an idle connection so browsers
+	// and any proxies in between don't time it out
+	sseHeartbeat = 15 * time.Second
+)
+
+// Events streams every order change to the client as Server-Sent Events
+// REF: https://html.spec.whatwg.org/multipage/server-sent-events.html
+func (h *Order) Events(w http.ResponseWriter, r *http.Request) {
+	h.streamEvents(w, r, func(model.Event) bool {
+		return true
+	})
+}
+
+// EventsByID streams the changes to a single order
+func (h *Order) EventsByID(w http.ResponseWriter, r *http.Request) {
+	orderID, err := parseOrderID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	h.streamEvents(w, r, func(event model.Event) bool {
+		return event.OrderID == orderID
+	})
+}
+
+func (h *Order) streamEvents(w http.ResponseWriter, r *http.Request, include func(model.Event) bool) {
+	// NOTE: We need to push each event out as soon as it's written,
+	// rather than when the handler returns
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, r, errors.New("ResponseWriter doesn't support flushing"))
+		return
+	}
+
+	ctx := r.Context()
+
+	// Browsers send back the ID of the last event they saw when they
+	// reconnect, so resume from there. Otherwise only send new events.
+	after := r.Header.Get("Last-Event-ID")
+	if after == "" {
+		last, err := h.Repo.LastEventID(ctx)
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		after = last
+	} else if !order.ValidEventID(after) {
+		writeError(w, r, invalidField("Last-Event-ID", "is not an event ID"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	lastWrite := time.Now()
+	for {
+		// Stop when the client goes away or the App is shutting down
+		select {
+		case <-ctx.Done():
+			return
+		case <-h.Shutdown:
+			return
+		default:
+		}
+
+		events, err := h.Repo.ReadEvents(ctx, after, sseBlock)
+		if err != nil {
+			if ctx.Err() == nil {
+				fmt.Println("Failed to read events:", err)
+			}
+			return
+		}
+
+		for _, event := range events {
+			after = event.ID
+			if !include(event) {
+				continue
+			}
+
+			data, err := json.Marshal(event)
+			if err != nil {
+				fmt.Println("Failed to marshal:", err)
+				return
+			}
+
+			fmt.Fprintf(w, "id: %s\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+			lastWrite = time.Now()
+		}
+
+		// Lines starting with ':' are comments, which clients ignore
+		if time.Since(lastWrite) >= sseHeartbeat {
+			fmt.Fprint(w, ": heartbeat\n\n")
+			lastWrite = time.Now()
+		}
+
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,136 @@
+package handler
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+// Largest line item body we'll read
+const maxItemBytes = 64 << 10
+
+// ListItems sends the order's line items
+func (h *Order) ListItems(w http.ResponseWriter, r *http.Request) {
+	orderID, err := parseOrderID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	o, err := h.Repo.FindByID(r.Context(), orderID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var response struct {
+		Items []model.LineItem `json:"items"`
+	}
+	response.Items = o.LineItems
+
+	w.Header().Set("ETag", formatETag(o.Revision))
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Println("Failed to marshal:", err)
+	}
+}
+
+// AddItem adds a line item to an order that hasn't shipped yet. Like the
+// other item changes, it responds with the whole order since the totals
+// change too.
+func (h *Order) AddItem(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Add a line item to an order")
+
+	var item model.LineItem
+	r.Body = http.MaxBytesReader(w, r.Body, maxItemBytes)
+	if err := decodeJSON(r.Body, &item); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if errs := item.Validate(""); len(errs) > 0 {
+		writeError(w, r, errs)
+		return
+	}
+
+	h.updateItems(w, r, http.StatusCreated, func(o *model.Order) error {
+		return o.AddLineItem(item)
+	})
+}
+
+// UpdateItem changes the quantity and/or price of one line item
+func (h *Order) UpdateItem(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Update a line item of an order")
+
+	itemID, err := parseItemID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var patch model.LineItemPatch
+	r.Body = http.MaxBytesReader(w, r.Body, maxItemBytes)
+	if err := decodeJSON(r.Body, &patch); err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	h.updateItems(w, r, http.StatusOK, func(o *model.Order) error {
+		return o.UpdateLineItem(itemID, patch)
+	})
+}
+
+func (h *Order) RemoveItem(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Remove a line item from an order")
+
+	itemID, err := parseItemID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	h.updateItems(w, r, http.StatusOK, func(o *model.Order) error {
+		return o.RemoveLineItem(itemID)
+	})
+}
+
+// U: Line item changes are ordinary order updates, so they get the same
+// WATCH/MULTI retries, If-Match checks and history entries as UpdateByID,
+// and the repo works out the new totals
+func (h *Order) updateItems(w http.ResponseWriter, r *http.Request, status int, fn func(*model.Order) error) {
+	orderID, err := parseOrderID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	var updatedOrder model.Order
+	err = ifMatch(r, func(ifRevision uint64) error {
+		var err error
+		updatedOrder, err = h.Repo.Update(r.Context(), orderID, ifRevision, fn)
+		return err
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", formatETag(updatedOrder.Revision))
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(updatedOrder); err != nil {
+		fmt.Println("Failed to marshal:", err)
+	}
+}
+
+// Pull the line item's ItemID out of the URL
+func parseItemID(r *http.Request) (uuid.UUID, error) {
+	itemID, err := uuid.Parse(chi.URLParam(r, "itemID"))
+	if err != nil {
+		return uuid.Nil, invalidField("itemID", "must be a UUID")
+	}
+	return itemID, nil
+}
@@ -1,11 +1,11 @@
 package handler
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
-	"math/rand"
 	"net/http"
 	"strconv"
 	// "text/template"
@@ -14,143 +14,276 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/google/uuid"
 
+	"github.com/gaylonalfano/go-redis-crud/idgen"
 	"github.com/gaylonalfano/go-redis-crud/model"
 	"github.com/gaylonalfano/go-redis-crud/repository/order"
 )
 
+// U: Depend on the order.Repo interface instead of *order.RedisRepo,
+// so we can swap datastores (e.g. order.MemoryRepo) without touching handlers
 type Order struct {
-	Repo *order.RedisRepo
+	Repo order.Repo
+	IDs  idgen.Generator
+	// Tax charged on new orders, in basis points (see model.Totals)
+	TaxRate uint
+	// Closed when the App is shutting down, so long-lived requests like
+	// the event streams know to finish up
+	Shutdown <-chan struct{}
+}
+
+// The expected POST data from client, for both Create and CreateBatch
+type createOrderBody struct {
+	CustomerID uuid.UUID        `json:"customer_id"`
+	LineItems  []model.LineItem `json:"line_items"`
+	// Optional, taken off the subtotal before tax
+	Discount        *model.Money   `json:"discount"`
+	Notes           string         `json:"notes"`
+	ShippingAddress *model.Address `json:"shipping_address"`
+}
+
+// Construct a new, pending model.Order from the (valid) body, with its
+// totals worked out. The ID is assigned when it's inserted.
+func (body createOrderBody) newOrder(now time.Time, taxRate uint) (model.Order, error) {
+	o := model.Order{
+		CustomerID:      body.CustomerID,
+		LineItems:       body.LineItems,
+		Notes:           body.Notes,
+		ShippingAddress: body.ShippingAddress,
+		Status:          model.StatusPending,
+		CreatedAt:       &now, // memory address only (*time.Time)
+		Revision:        1,
+	}
+
+	o.Totals.TaxRate = taxRate
+	if body.Discount != nil {
+		o.Totals.Discount = *body.Discount
+	}
+	if err := o.CalculateTotals(); err != nil {
+		return model.Order{}, err
+	}
+
+	return o, nil
 }
 
 func (h *Order) Create(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Create an order")
-	// 'body' has anonymous type and declared inline. 'body' will
-	// represent the expected POST data from client
-	var body struct {
-		CustomerID uuid.UUID        `json:"customer_id"`
-		LineItems  []model.LineItem `json:"line_items"`
-	}
+	// 'body' will represent the expected POST data from client
+	var body createOrderBody
 
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+	r.Body = http.MaxBytesReader(w, r.Body, MaxCreateBytes)
+	if err := decodeJSON(r.Body, &body); err != nil {
 		// Send bad status code if fails, since we'd send bad input data
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err)
+		return
+	}
+
+	if err := body.validate(); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	// Construct our model.Order so we can insert it
-	now := time.Now().UTC() // time.Time
-	order := model.Order{
-		OrderID:    rand.Uint64(), // Not for production!
-		CustomerID: body.CustomerID,
-		LineItems:  body.LineItems,
-		CreatedAt:  &now, // memory address only (*time.Time)
+	order, err := body.newOrder(time.Now().UTC(), h.TaxRate)
+	if err != nil {
+		writeError(w, r, err)
+		return
 	}
 
-	err := h.Repo.Insert(r.Context(), order)
+	err = h.insertWithNewID(r.Context(), &order)
 	if err != nil {
-		fmt.Println("Failed to insert:", err)
-		// Send 500 code since something broke on our end
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
 	// Return our generated model.Order to the Client
 	res, err := json.Marshal(order)
 	if err != nil {
-		fmt.Println("Failed to encode:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	w.Write(res)
+	// NOTE: Headers and status must be written before the body
+	w.Header().Set("ETag", formatETag(order.Revision))
 	w.WriteHeader(http.StatusCreated) // 201
+	w.Write(res)
+}
+
+// Assign the order a fresh ID and insert it. A taken ID (only really
+// possible with idgen.Random) just means we try again with another one.
+func (h *Order) insertWithNewID(ctx context.Context, o *model.Order) error {
+	const maxAttempts = 3
+
+	var err error
+	for i := 0; i < maxAttempts; i++ {
+		o.OrderID, err = h.IDs.NextID(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = h.Repo.Insert(ctx, *o)
+		if !errors.Is(err, order.ErrAlreadyExists) {
+			return err
+		}
+	}
+
+	return err
 }
 
 func (h *Order) List(w http.ResponseWriter, r *http.Request) {
-	// Users will pass in a query param for cursor or page number (pagination)
-	cursorStr := r.URL.Query().Get("cursor")
-	// If nothing passed, then set to 0
-	if cursorStr == "" {
-		cursorStr = "0"
-	}
-	// Parse cursor into a uint64
-	const decimal = 10
-	const bitSize = 64
-	cursor, err := strconv.ParseUint(cursorStr, decimal, bitSize)
-	// FIXME: Cursor is always zero, so never get next cursor position
-	fmt.Println("strconv.ParseUint() cursor:", cursor) // 0!
+	page, err := parsePage(r)
 	if err != nil {
-		fmt.Println("Bad cursor", err)
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
 	// Call our Repo's FindAll()
+	res, err := h.Repo.FindAll(r.Context(), page)
+	data, ok := writePage(w, r, res, err)
+	if !ok {
+		return
+	}
+
+	// U: Experimenting with Go Templates + HTMX
+	// t := template.Must(template.ParseFiles("index.html"))
+	t := template.Must(template.New("index.html").Parse("index.html"))
+
+	// Q: What data to pass? Encoded JSON?
+	// Q: Should I use text/template package instead of html/template?
+	// t.ExecuteTemplate(w, "order-list-element", response.Items) // json output
+	// t.ExecuteTemplate(w, "order-list-element", data)
+	t.Execute(w, data)
+
+}
+
+func (h *Order) ListByCustomer(w http.ResponseWriter, r *http.Request) {
+	customerID, err := uuid.Parse(chi.URLParam(r, "customerID"))
+	if err != nil {
+		writeError(w, r, invalidField("customerID", "must be a UUID"))
+		return
+	}
+
+	page, err := parsePage(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	res, err := h.Repo.FindByCustomer(r.Context(), customerID, page)
+	writePage(w, r, res, err)
+}
+
+// Users will pass in an opaque cursor (from a previous response's
+// "next") for pagination, and optionally sort=asc|desc, status=...,
+// deleted=true (the trash) and created_after/created_before RFC 3339
+// timestamps to filter by
+func parsePage(r *http.Request) (order.FindAllPage, error) {
+	query := r.URL.Query()
+
 	const size = 50
-	res, err := h.Repo.FindAll(r.Context(), order.FindAllPage{
-		Offset: cursor,
+	page := order.FindAllPage{
 		Size:   size,
-	})
-	fmt.Println("FindResult:", res)
+		Cursor: query.Get("cursor"),
+		Sort:   order.SortOrder(query.Get("sort")),
+		Status: model.Status(query.Get("status")),
+	}
+
+	switch page.Sort {
+	case "":
+		page.Sort = order.SortAsc
+	case order.SortAsc, order.SortDesc:
+	default:
+		return order.FindAllPage{}, invalidField("sort", "must be asc or desc")
+	}
+
+	if s := query.Get("deleted"); s != "" {
+		deleted, err := strconv.ParseBool(s)
+		if err != nil {
+			return order.FindAllPage{}, invalidField("deleted", "must be true or false")
+		}
+		page.Deleted = deleted
+	}
+
+	if page.Status != "" && !page.Status.Valid() {
+		return order.FindAllPage{}, invalidField("status", fmt.Sprintf("%q is not an order status", page.Status))
+	}
+
+	if s := query.Get("created_after"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return order.FindAllPage{}, invalidField("created_after", "must be an RFC 3339 timestamp")
+		}
+		page.CreatedAfter = &t
+	}
+
+	if s := query.Get("created_before"); s != "" {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			return order.FindAllPage{}, invalidField("created_before", "must be an RFC 3339 timestamp")
+		}
+		page.CreatedBefore = &t
+	}
+
+	return page, nil
+}
+
+// Write a page of orders (or the error from fetching it) to the client.
+// Returns the encoded JSON and whether it was written successfully.
+func writePage(w http.ResponseWriter, r *http.Request, res order.FindResult, err error) ([]byte, bool) {
 	if err != nil {
-		fmt.Println("Failed to find all:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		writeError(w, r, err)
+		return nil, false
 	}
 
 	// Craft our response with an anonymous struct
-	// Using omitempty if Next == 0, i.e. no more pages
+	// Using omitempty if Next == "", i.e. no more pages
 	var response struct {
 		Items []model.Order `json:"items"`
-		Next  uint64        `json:"next,omitempty"`
+		Next  string        `json:"next,omitempty"`
 	}
 	response.Items = res.Orders
-	response.Next = res.Cursor
-	fmt.Println("response struct:", response)
+	response.Next = res.Next
 
 	data, err := json.Marshal(response)
 	if err != nil {
-		fmt.Println("Failed to marshal:", err)
-		w.WriteHeader(http.StatusInternalServerError)
-		return
+		writeError(w, r, err)
+		return nil, false
 	}
 
 	w.Write(data)
 
-	// U: Experimenting with Go Templates + HTMX
-	// t := template.Must(template.ParseFiles("index.html"))
-	t := template.Must(template.New("index.html").Parse("index.html"))
+	return data, true
+}
 
-	// Q: What data to pass? Encoded JSON?
-	// Q: Should I use text/template package instead of html/template?
-	// t.ExecuteTemplate(w, "order-list-element", response.Items) // json output
-	// t.ExecuteTemplate(w, "order-list-element", data)
-	t.Execute(w, data)
+// Pull the order ID out of the URL
+func parseOrderID(r *http.Request) (uint64, error) {
+	const base = 10
+	const bitSize = 64
 
+	orderID, err := strconv.ParseUint(chi.URLParam(r, "id"), base, bitSize)
+	if err != nil {
+		return 0, invalidField("id", "must be a positive integer")
+	}
+	return orderID, nil
 }
 
 func (h *Order) GetByID(w http.ResponseWriter, r *http.Request) {
 	fmt.Println("Get an order by ID")
-	idParam := chi.URLParam(r, "id")
-
-	// Convert to uint64
-	const base = 10
-	const bitSize = 64
-
-	orderID, err := strconv.ParseUint(idParam, base, bitSize)
+	orderID, err := parseOrderID(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
 	o, err := h.Repo.FindByID(r.Context(), orderID)
-	// Check whether err is our custom error
-	if errors.Is(err, order.ErrNotExist) {
-		w.WriteHeader(http.StatusNotFound)
+	if err != nil {
+		writeError(w, r, err)
 		return
-	} else if err != nil {
-		fmt.Println("Failed to find by id:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	// Let clients skip re-downloading an order they already have
+	w.Header().Set("ETag", formatETag(o.Revision))
+	if noneMatch(r, o.Revision) {
+		w.WriteHeader(http.StatusNotModified)
 		return
 	}
 
@@ -171,97 +304,135 @@ func (h *Order) UpdateByID(w http.ResponseWriter, r *http.Request) {
 		Status string `json:"status"`
 	}
 
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+	r.Body = http.MaxBytesReader(w, r.Body, MaxCreateBytes)
+	if err := decodeJSON(r.Body, &body); err != nil {
+		writeError(w, r, err)
 		return
 	}
 
 	// Pull out the Order ID
-	idParam := chi.URLParam(r, "id")
+	orderID, err := parseOrderID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	const base = 10
-	const bitSize = 64
+	// Unknown statuses can be rejected before we touch the repo
+	status := model.Status(body.Status)
+	if !status.Valid() {
+		writeError(w, r, invalidField("status", fmt.Sprintf("%q is not an order status", body.Status)))
+		return
+	}
 
-	orderID, err := strconv.ParseUint(idParam, base, bitSize)
+	// U: The repo hands us the latest stored version of the order and
+	// only saves our changes if nobody else changed it in the meantime.
+	// The model's state machine decides whether the change is allowed.
+	now := time.Now().UTC()
+	var updatedOrder model.Order
+	// Only apply the update if the client's copy is still current
+	err = ifMatch(r, func(ifRevision uint64) error {
+		var err error
+		updatedOrder, err = h.Repo.Update(r.Context(), orderID, ifRevision, func(currentOrder *model.Order) error {
+			return currentOrder.Transition(status, now)
+		})
+		return err
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	// Retrieve existing order
-	currentOrder, err := h.Repo.FindByID(r.Context(), orderID)
-	if errors.Is(err, order.ErrNotExist) {
-		w.WriteHeader(http.StatusNotFound)
-		return
-	} else if err != nil {
-		fmt.Println("Failed to find by id:", err)
+	w.Header().Set("ETag", formatETag(updatedOrder.Revision))
+
+	// If all is well, send it back to client encoded as JSON
+	if err := json.NewEncoder(w).Encode(updatedOrder); err != nil {
+		fmt.Println("Failed to marshal:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// Only allow updating Order if certain conditions met
-	const completedStatus = "completed"
-	const shippedStatus = "shipped"
-	now := time.Now().UTC()
+}
+
+// DeleteByID moves the order to the trash, where it can be restored from
+// until it's purged. ?purge=true purges an order that's already in the
+// trash, for good.
+func (h *Order) DeleteByID(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Delete an order by ID")
+	orderID, err := parseOrderID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
 
-	switch body.Status {
-	case shippedStatus:
-		if currentOrder.ShippedAt != nil {
-			// TODO: Send by custom error messages to client
-			fmt.Println("Failed to update status to:", shippedStatus)
-			w.WriteHeader(http.StatusBadRequest)
+	purge := false
+	if s := r.URL.Query().Get("purge"); s != "" {
+		purge, err = strconv.ParseBool(s)
+		if err != nil {
+			writeError(w, r, invalidField("purge", "must be true or false"))
 			return
 		}
-		currentOrder.ShippedAt = &now
-	case completedStatus:
-		if currentOrder.CompletedAt != nil || currentOrder.ShippedAt == nil {
-			fmt.Println("Failed to update status to:", completedStatus)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+	}
+
+	err = ifMatch(r, func(ifRevision uint64) error {
+		if purge {
+			return h.Repo.Purge(r.Context(), orderID, ifRevision)
 		}
-		currentOrder.CompletedAt = &now
-	default:
-		w.WriteHeader(http.StatusBadRequest)
+		return h.Repo.DeleteByID(r.Context(), orderID, ifRevision)
+	})
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
-	err = h.Repo.Update(r.Context(), currentOrder)
+}
+
+// Restore takes a deleted order back out of the trash
+func (h *Order) Restore(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Restore an order by ID")
+	orderID, err := parseOrderID(r)
 	if err != nil {
-		fmt.Println("Failed to insert:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		writeError(w, r, err)
 		return
 	}
 
-	// If all is well, send it back to client encoded as JSON
-	if err := json.NewEncoder(w).Encode(currentOrder); err != nil {
-		fmt.Println("Failed to marshal:", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	var restored model.Order
+	err = ifMatch(r, func(ifRevision uint64) error {
+		var err error
+		restored, err = h.Repo.Restore(r.Context(), orderID, ifRevision)
+		return err
+	})
+	if err != nil {
+		writeError(w, r, err)
 		return
 	}
 
+	w.Header().Set("ETag", formatETag(restored.Revision))
+	if err := json.NewEncoder(w).Encode(restored); err != nil {
+		fmt.Println("Failed to marshal:", err)
+	}
 }
 
-func (h *Order) DeleteByID(w http.ResponseWriter, r *http.Request) {
-	fmt.Println("Delete an order by ID")
-	idParam := chi.URLParam(r, "id")
-
-	const base = 10
-	const bitSize = 64
-
-	orderID, err := strconv.ParseUint(idParam, base, bitSize)
+func (h *Order) History(w http.ResponseWriter, r *http.Request) {
+	orderID, err := parseOrderID(r)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		writeError(w, r, err)
 		return
 	}
 
-	err = h.Repo.DeleteByID(r.Context(), orderID)
-	if errors.Is(err, order.ErrNotExist) {
-		w.WriteHeader(http.StatusNotFound)
+	entries, err := h.Repo.History(r.Context(), orderID)
+	if err != nil {
+		writeError(w, r, err)
 		return
-	} else if err != nil {
-		fmt.Println("Failed to find by id:", err)
+	}
+
+	var response struct {
+		Items []model.AuditEntry `json:"items"`
+	}
+	response.Items = entries
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		fmt.Println("Failed to marshal:", err)
 		w.WriteHeader(http.StatusInternalServerError)
 		return
 	}
-
 }
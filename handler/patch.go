@@ -0,0 +1,121 @@
+package handler
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"time"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+	"github.com/gaylonalfano/go-redis-crud/problem"
+)
+
+const mergePatchType = "application/merge-patch+json"
+
+// Largest patch body we'll read
+const maxPatchBytes = 1 << 20
+
+// PatchByID changes an order with a JSON Merge Patch, e.g.
+// {"notes": "Leave by the door", "shipping_address": null}.
+// Only the fields model.Order.ApplyPatch allows can be changed.
+// REF: https://www.rfc-editor.org/rfc/rfc7396
+func (h *Order) PatchByID(w http.ResponseWriter, r *http.Request) {
+	fmt.Println("Patch an order by ID")
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != mergePatchType {
+		w.Header().Set("Accept-Patch", mergePatchType)
+		writeError(w, r, problem.New(http.StatusUnsupportedMediaType, "Content-Type must be "+mergePatchType))
+		return
+	}
+
+	var patch map[string]any
+	r.Body = http.MaxBytesReader(w, r.Body, maxPatchBytes)
+	if err := decodeJSON(r.Body, &patch); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	// NOTE: A merge patch that isn't an object would replace the whole
+	// order, which is never valid
+	if patch == nil {
+		writeError(w, r, invalidRequest("Body must be a JSON object"))
+		return
+	}
+
+	orderID, err := parseOrderID(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	// U: The patch is applied to the JSON of the latest stored version
+	// inside Update, so it gets the same WATCH/MULTI guarantees as status
+	// updates, then the model decides which changes are allowed
+	now := time.Now().UTC()
+	apply := func(currentOrder *model.Order) error {
+		current, err := json.Marshal(currentOrder)
+		if err != nil {
+			return err
+		}
+
+		var doc map[string]any
+		dec := json.NewDecoder(bytes.NewReader(current))
+		dec.UseNumber()
+		if err := dec.Decode(&doc); err != nil {
+			return err
+		}
+		merged, err := json.Marshal(mergePatch(doc, patch))
+		if err != nil {
+			return err
+		}
+
+		var patched model.Order
+		if err := decodeJSON(bytes.NewReader(merged), &patched); err != nil {
+			return err
+		}
+
+		return currentOrder.ApplyPatch(patched, now)
+	}
+
+	var updatedOrder model.Order
+	err = ifMatch(r, func(ifRevision uint64) error {
+		var err error
+		updatedOrder, err = h.Repo.Update(r.Context(), orderID, ifRevision, apply)
+		return err
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	w.Header().Set("ETag", formatETag(updatedOrder.Revision))
+	if err := json.NewEncoder(w).Encode(updatedOrder); err != nil {
+		fmt.Println("Failed to marshal:", err)
+	}
+}
+
+// Apply a merge patch to a JSON document: objects are merged key by key,
+// null removes a key, and anything else replaces what was there
+func mergePatch(target any, patch any) any {
+	patchObj, ok := patch.(map[string]any)
+	if !ok {
+		return patch
+	}
+
+	targetObj, ok := target.(map[string]any)
+	if !ok {
+		targetObj = make(map[string]any)
+	}
+
+	for key, value := range patchObj {
+		if value == nil {
+			delete(targetObj, key)
+		} else {
+			targetObj[key] = mergePatch(targetObj[key], value)
+		}
+	}
+
+	return targetObj
+}
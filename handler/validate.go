@@ -0,0 +1,101 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/google/uuid"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+// Largest create body we'll read. Plenty for model.MaxLineItems items.
+// Exported for the same reason as MaxBatchBytes.
+const MaxCreateBytes = 1 << 20
+
+// Check the whole body and report every problem with it, not just the first
+func (body createOrderBody) validate() error {
+	var errs model.ValidationError
+	if body.CustomerID == uuid.Nil {
+		errs = append(errs, model.FieldError{Field: "customer_id", Message: "is required"})
+	}
+	errs = append(errs, model.ValidateLineItems(body.LineItems)...)
+	if body.Discount != nil {
+		errs = append(errs, model.ValidateDiscount(*body.Discount, body.LineItems)...)
+	}
+	errs = append(errs, model.ValidateNotes(body.Notes)...)
+	if body.ShippingAddress != nil {
+		errs = append(errs, body.ShippingAddress.Validate("shipping_address")...)
+	}
+
+	// NOTE: Return a plain nil, a nil ValidationError would be a non-nil error
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// Decode a JSON request body into v. Unlike a plain json.Decoder this
+// rejects fields v doesn't have, so typos like "customerid" aren't
+// silently ignored, and anything after the JSON value.
+func decodeJSON(r io.Reader, v any) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	// NOTE: Keep numbers decoded into an `any` exact. As float64s, large
+	// order IDs would lose precision.
+	dec.UseNumber()
+
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return invalidRequest("Body must contain a single JSON value")
+	}
+
+	return nil
+}
+
+// Turn a json decoding error into a problem, pointing at the field where
+// we can
+func decodeError(err error) error {
+	var typeErr *json.UnmarshalTypeError
+	var maxBytesErr *http.MaxBytesError
+
+	switch {
+	case errors.As(err, &maxBytesErr):
+		// Mapped to a 413 by problemFor
+		return err
+	case errors.As(err, &typeErr) && typeErr.Field != "":
+		return invalidField(fieldPath(typeErr.Field), fmt.Sprintf("has the wrong type: got %s, want %s", typeErr.Value, typeErr.Type))
+	case strings.HasPrefix(err.Error(), "json: unknown field "):
+		// NOTE: encoding/json has no error type for this, only the message
+		field := strings.Trim(strings.TrimPrefix(err.Error(), "json: unknown field "), `"`)
+		return invalidField(field, "is not a known field")
+	default:
+		return invalidRequest("Body must be valid JSON: " + err.Error())
+	}
+}
+
+// encoding/json reports fields as "line_items.0.quantity". Write array
+// indexes the same way model.ValidationError does: "line_items[0].quantity".
+func fieldPath(field string) string {
+	parts := strings.Split(field, ".")
+
+	var path strings.Builder
+	for i, part := range parts {
+		if part != "" && strings.Trim(part, "0123456789") == "" {
+			path.WriteString("[" + part + "]")
+			continue
+		}
+		if i > 0 {
+			path.WriteString(".")
+		}
+		path.WriteString(part)
+	}
+
+	return path.String()
+}
@@ -0,0 +1,76 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryStore is the in-process equivalent of RedisStore, for running
+// without Redis
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]memoryRecord
+}
+
+type memoryRecord struct {
+	Record
+	expiresAt time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		records: make(map[string]memoryRecord),
+	}
+}
+
+func (s *MemoryStore) Begin(ctx context.Context, key string, fingerprint string, lockTTL time.Duration) (*Record, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	if existing, ok := s.records[key]; ok && now.Before(existing.expiresAt) {
+		record := existing.Record
+		return &record, nil
+	}
+
+	s.records[key] = memoryRecord{
+		Record: Record{
+			State:       StatePending,
+			Fingerprint: fingerprint,
+		},
+		expiresAt: now.Add(lockTTL),
+	}
+
+	// NOTE: Nothing else evicts expired records, so tidy up while we
+	// hold the lock anyway
+	for k, record := range s.records {
+		if now.After(record.expiresAt) {
+			delete(s.records, k)
+		}
+	}
+
+	return nil, nil
+}
+
+func (s *MemoryStore) Complete(ctx context.Context, key string, record Record, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record.State = StateDone
+	s.records[key] = memoryRecord{
+		Record:    record,
+		expiresAt: time.Now().Add(ttl),
+	}
+
+	return nil
+}
+
+func (s *MemoryStore) Release(ctx context.Context, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+
+	return nil
+}
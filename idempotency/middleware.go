@@ -0,0 +1,161 @@
+package idempotency
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/gaylonalfano/go-redis-crud/problem"
+)
+
+const (
+	Header = "Idempotency-Key"
+	// Set on responses that were replayed from the store
+	ReplayedHeader = "Idempotent-Replayed"
+
+	// Longest key we'll accept, to keep clients from stuffing Redis
+	maxKeyLength = 255
+	// How long a key stays claimed by a request still being handled.
+	// Bounds how long a crashed request blocks retries.
+	lockTTL = 30 * time.Second
+)
+
+// Response headers worth replaying along with the status and body
+var replayedHeaders = []string{"Content-Type", "ETag", "Location"}
+
+// Middleware makes the wrapped handler idempotent for requests carrying an
+// Idempotency-Key header. Responses are kept for ttl. Requests without the
+// header pass straight through.
+// NOTE: The body is read up front to fingerprint it, so maxBodyBytes
+// should be the same limit the wrapped handler puts on its body.
+// Otherwise requests the handler would accept get a 413 just for
+// carrying a key.
+func Middleware(store Store, ttl time.Duration, maxBodyBytes int64) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := r.Header.Get(Header)
+			if key == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if len(key) > maxKeyLength {
+				problem.Write(w, r, problem.New(http.StatusBadRequest, "Idempotency-Key is too long"))
+				return
+			}
+
+			// Read the body so we can fingerprint it, then put it back
+			// for the handler
+			body, err := io.ReadAll(io.LimitReader(r.Body, maxBodyBytes+1))
+			if err != nil {
+				problem.Write(w, r, problem.New(http.StatusBadRequest, "Failed to read request body"))
+				return
+			}
+			if int64(len(body)) > maxBodyBytes {
+				problem.Write(w, r, problem.New(http.StatusRequestEntityTooLarge, ""))
+				return
+			}
+			r.Body = io.NopCloser(bytes.NewReader(body))
+
+			fingerprint := fingerprintRequest(r, body)
+			ctx := r.Context()
+
+			existing, err := store.Begin(ctx, key, fingerprint, lockTTL)
+			if err != nil {
+				fmt.Println("Failed to begin idempotent request:", err)
+				problem.Write(w, r, problem.New(http.StatusInternalServerError, ""))
+				return
+			}
+
+			if existing != nil {
+				switch {
+				case existing.Fingerprint != fingerprint:
+					// Same key, different request. Almost certainly a client bug
+					problem.Write(w, r, problem.New(http.StatusUnprocessableEntity, "Idempotency-Key was already used for a different request"))
+				case existing.State == StatePending:
+					// The first request is still running, so we have nothing
+					// to replay yet. Ask the client to retry shortly.
+					w.Header().Set("Retry-After", "1")
+					problem.Write(w, r, problem.New(http.StatusConflict, "A request with this Idempotency-Key is in progress"))
+				default:
+					replay(w, existing)
+				}
+				return
+			}
+
+			// We claimed the key, so handle the request and record what
+			// we send back
+			rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+			next.ServeHTTP(rec, r)
+
+			// NOTE: Server errors aren't stored, so the client can retry
+			// them with the same key
+			if rec.status >= http.StatusInternalServerError {
+				if err := store.Release(ctx, key); err != nil {
+					fmt.Println("Failed to release idempotency key:", err)
+				}
+				return
+			}
+
+			record := Record{
+				Fingerprint: fingerprint,
+				Status:      rec.status,
+				Header:      make(map[string]string),
+				Body:        rec.body.Bytes(),
+			}
+			for _, name := range replayedHeaders {
+				if value := w.Header().Get(name); value != "" {
+					record.Header[name] = value
+				}
+			}
+
+			if err := store.Complete(ctx, key, record, ttl); err != nil {
+				fmt.Println("Failed to store idempotent response:", err)
+			}
+		})
+	}
+}
+
+// NOTE: The query is part of the request too, e.g. ?atomic=true changes
+// what a batch does, so it has to change the fingerprint
+func fingerprintRequest(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s %s?%s\n", r.Method, r.URL.Path, r.URL.RawQuery)
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func replay(w http.ResponseWriter, record *Record) {
+	for name, value := range record.Header {
+		w.Header().Set(name, value)
+	}
+	w.Header().Set(ReplayedHeader, "true")
+	w.WriteHeader(record.Status)
+	w.Write(record.Body)
+}
+
+// recorder passes the response through to the client while keeping a
+// copy of the status and body to store
+type recorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (rec *recorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *recorder) Write(b []byte) (int, error) {
+	rec.wroteHeader = true
+	rec.body.Write(b)
+	return rec.ResponseWriter.Write(b)
+}
@@ -0,0 +1,76 @@
+package idempotency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+type RedisStore struct {
+	Client redis.UniversalClient
+}
+
+func generateKey(key string) string {
+	return fmt.Sprintf("idempotency:%s", key)
+}
+
+func (s *RedisStore) Begin(ctx context.Context, key string, fingerprint string, lockTTL time.Duration) (*Record, error) {
+	data, err := json.Marshal(Record{
+		State:       StatePending,
+		Fingerprint: fingerprint,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode idempotency record: %w", err)
+	}
+
+	// NOTE: SetNX() is atomic, so only one of several concurrent requests
+	// with the same key can claim it
+	claimed, err := s.Client.SetNX(ctx, generateKey(key), string(data), lockTTL).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to claim idempotency key: %w", err)
+	}
+	if claimed {
+		return nil, nil
+	}
+
+	value, err := s.Client.Get(ctx, generateKey(key)).Result()
+	if errors.Is(err, redis.Nil) {
+		// Expired between our SETNX and GET, so try again
+		return s.Begin(ctx, key, fingerprint, lockTTL)
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to get idempotency record: %w", err)
+	}
+
+	var record Record
+	if err := json.Unmarshal([]byte(value), &record); err != nil {
+		return nil, fmt.Errorf("Failed to decode idempotency record: %w", err)
+	}
+
+	return &record, nil
+}
+
+func (s *RedisStore) Complete(ctx context.Context, key string, record Record, ttl time.Duration) error {
+	record.State = StateDone
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("Failed to encode idempotency record: %w", err)
+	}
+
+	if err := s.Client.Set(ctx, generateKey(key), string(data), ttl).Err(); err != nil {
+		return fmt.Errorf("Failed to store idempotency record: %w", err)
+	}
+
+	return nil
+}
+
+func (s *RedisStore) Release(ctx context.Context, key string) error {
+	if err := s.Client.Del(ctx, generateKey(key)).Err(); err != nil {
+		return fmt.Errorf("Failed to release idempotency key: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+// Package idempotency lets clients safely retry POST requests by sending
+// an Idempotency-Key header. The first response for a key is stored and
+// replayed for any retries, instead of running the handler again.
+// REF: https://datatracker.ietf.org/doc/draft-ietf-httpapi-idempotency-key-header/
+package idempotency
+
+import (
+	"context"
+	"time"
+)
+
+type State string
+
+const (
+	// The first request with the key is still being handled
+	StatePending State = "pending"
+	// The first request finished and its response is stored
+	StateDone State = "done"
+)
+
+type Record struct {
+	State State `json:"state"`
+	// Hash of the request the key was first used for, so we can spot the
+	// same key being reused for a different request
+	Fingerprint string            `json:"fingerprint"`
+	Status      int               `json:"status,omitempty"`
+	Header      map[string]string `json:"header,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+}
+
+type Store interface {
+	// Begin claims the key for a request by storing a pending record that
+	// expires after lockTTL. Returns nil if the key was claimed, otherwise
+	// the record already stored for it.
+	Begin(ctx context.Context, key string, fingerprint string, lockTTL time.Duration) (*Record, error)
+	// Complete stores the finished response for a claimed key
+	Complete(ctx context.Context, key string, record Record, ttl time.Duration) error
+	// Release gives up a claimed key, so the request can be retried
+	Release(ctx context.Context, key string) error
+}
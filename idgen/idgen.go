@@ -0,0 +1,21 @@
+// Package idgen hands out order IDs. Pick an implementation with
+// application.Config.IDGenerator.
+package idgen
+
+import (
+	"context"
+	"math/rand"
+)
+
+type Generator interface {
+	NextID(ctx context.Context) (uint64, error)
+}
+
+// Random is the original rand.Uint64() approach. Not for production!
+// IDs aren't ordered, and nothing stops two orders drawing the same one
+// (the repository will reject the second with order.ErrAlreadyExists).
+type Random struct{}
+
+func (Random) NextID(ctx context.Context) (uint64, error) {
+	return rand.Uint64(), nil
+}
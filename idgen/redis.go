@@ -0,0 +1,33 @@
+package idgen
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Default key for RedisSequence
+const DefaultSequenceKey = "orders:id_seq"
+
+// RedisSequence hands out 1, 2, 3, ... using INCR, which is atomic, so
+// IDs are unique and monotonic across every instance of the service
+type RedisSequence struct {
+	Client redis.UniversalClient
+	// Defaults to DefaultSequenceKey
+	Key string
+}
+
+func (s *RedisSequence) NextID(ctx context.Context) (uint64, error) {
+	key := s.Key
+	if key == "" {
+		key = DefaultSequenceKey
+	}
+
+	id, err := s.Client.Incr(ctx, key).Uint64()
+	if err != nil {
+		return 0, fmt.Errorf("Failed to increment order id sequence: %w", err)
+	}
+
+	return id, nil
+}
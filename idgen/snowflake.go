@@ -0,0 +1,73 @@
+package idgen
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// Snowflake generates time-sortable IDs without talking to anything,
+// laid out like Twitter's Snowflake IDs:
+//
+//	41 bits milliseconds since SnowflakeEpoch | 10 bits node | 12 bits sequence
+//
+// Every process generating IDs needs its own node ID (0-1023) for the
+// IDs to be collision-free.
+// REF: https://en.wikipedia.org/wiki/Snowflake_ID
+type Snowflake struct {
+	node uint64
+
+	mu     sync.Mutex
+	lastMs int64
+	seq    uint64
+}
+
+// 2023-01-01T00:00:00Z, which gives us ~69 years of IDs
+var SnowflakeEpoch = time.Date(2023, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+const (
+	nodeBits = 10
+	seqBits  = 12
+	MaxNode  = 1<<nodeBits - 1
+	maxSeq   = 1<<seqBits - 1
+)
+
+var ErrInvalidNode = errors.New("Snowflake node ID must be between 0 and 1023")
+
+func NewSnowflake(node uint16) (*Snowflake, error) {
+	if node > MaxNode {
+		return nil, ErrInvalidNode
+	}
+	return &Snowflake{node: uint64(node)}, nil
+}
+
+func (s *Snowflake) NextID(ctx context.Context) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ms := time.Since(SnowflakeEpoch).Milliseconds()
+
+	// NOTE: If the clock goes backwards, keep using the last millisecond
+	// so IDs stay monotonic
+	if ms < s.lastMs {
+		ms = s.lastMs
+	}
+
+	if ms == s.lastMs {
+		s.seq++
+		if s.seq > maxSeq {
+			// Used up this millisecond, wait for the next one
+			for ms <= s.lastMs {
+				time.Sleep(100 * time.Microsecond)
+				ms = time.Since(SnowflakeEpoch).Milliseconds()
+			}
+			s.seq = 0
+		}
+	} else {
+		s.seq = 0
+	}
+	s.lastMs = ms
+
+	return uint64(ms)<<(nodeBits+seqBits) | s.node<<seqBits | s.seq, nil
+}
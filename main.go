@@ -11,22 +11,27 @@ import (
 
 // NOTE:
 // - Get Docker going: docker run -p 6379:6379 redis:latest
+//    -- Or skip Redis entirely with STORAGE_BACKEND=memory
 // - Get our server going: go run main.go
 // - Then start using GET/POST requests to add data
-// - Use redis-cli command to the GET "order:XXXX" and SMEMBERS orders
+// - Use redis-cli command to the GET "{orders}:order:XXXX" and ZRANGE "{orders}:orders:created" 0 -1 WITHSCORES
+//    -- With REDIS_ORDER_LAYOUT=hash it's HGETALL "{orders}:order:XXXX" instead
 
 // TODO: Future enhancements:
 // - Add GoDotEnv package to autoload ENV vars
 // - Consider combining repository, model, handler packages into one 'order' package
 //    -- e.g., Create a root dir 'order' then order/{model,redisrepo,handler}.go
-// - Use a Go interface: type Repo interface {Insert() error, ... FindAll() (FindResult, error)}
-//    -- This would allow to swap datastores. type Order struct { Repo Repo }
 // - Swap out a new data store (PG, Turso, etc). See if Order data in PG still works
 // - Add testing
 
 func main() {
 	// U: Use our custom LoadConfig() helper to get instance of Config
-	app := application.New(application.LoadConfig())
+	config, err := application.LoadConfig()
+	if err != nil {
+		fmt.Println("Failed to load config:", err)
+		os.Exit(1)
+	}
+	app := application.New(config)
 
 	// NOTE: Create/derive a root Context.
 	// Learn more about Context and how it can signal a graceful shutdown
@@ -38,7 +43,7 @@ func main() {
 	// function it resides in; meaning I could call cancel() at end of main().
 	defer cancel()
 
-	err := app.Start(ctx)
+	err = app.Start(ctx)
 	if err != nil {
 		fmt.Println("Failed to start app:", err)
 	}
@@ -0,0 +1,49 @@
+package model
+
+import "unicode/utf8"
+
+// Longest Notes we'll store on an order
+const MaxNotesLength = 2000
+
+type Address struct {
+	Name       string `json:"name"`
+	Line1      string `json:"line1"`
+	Line2      string `json:"line2,omitempty"`
+	City       string `json:"city"`
+	Region     string `json:"region,omitempty"`
+	PostalCode string `json:"postal_code"`
+	// ISO 3166-1 alpha-2 code, e.g. "US"
+	Country string `json:"country"`
+}
+
+// Validate checks the address is complete enough to ship to. path is
+// where the address sits in the value being validated.
+func (a Address) Validate(path string) ValidationError {
+	var errs ValidationError
+	required := []struct {
+		field, value string
+	}{
+		{"name", a.Name},
+		{"line1", a.Line1},
+		{"city", a.City},
+		{"postal_code", a.PostalCode},
+	}
+	for _, r := range required {
+		if r.value == "" {
+			errs.add(fieldPath(path, r.field), "is required")
+		}
+	}
+
+	if len(a.Country) != 2 || !isUpper(a.Country) {
+		errs.add(fieldPath(path, "country"), "must be an ISO 3166-1 alpha-2 country code")
+	}
+	return errs
+}
+
+func ValidateNotes(notes string) ValidationError {
+	var errs ValidationError
+	if utf8.RuneCountInString(notes) > MaxNotesLength {
+		errs.add("notes", "must be at most %d characters", MaxNotesLength)
+	}
+	return errs
+}
@@ -0,0 +1,26 @@
+package model
+
+import "time"
+
+type AuditAction string
+
+const (
+	AuditCreated       AuditAction = "created"
+	AuditStatusChanged AuditAction = "status_changed"
+	AuditUpdated       AuditAction = "updated"
+	AuditDeleted       AuditAction = "deleted" // moved to the trash
+	AuditRestored      AuditAction = "restored"
+	AuditPurged        AuditAction = "purged" // deleted for good
+)
+
+// One entry in an order's history, appended by the repository in the
+// same transaction as the change it describes
+type AuditEntry struct {
+	Action    AuditAction `json:"action"`
+	Actor     string      `json:"actor"`
+	At        time.Time   `json:"at"`
+	From      Status      `json:"from,omitempty"`
+	To        Status      `json:"to,omitempty"`
+	Revision  uint64      `json:"revision"`
+	RequestID string      `json:"request_id,omitempty"`
+}
@@ -0,0 +1,31 @@
+package model
+
+import "time"
+
+type EventType string
+
+const (
+	EventCreated  EventType = "order.created"
+	EventUpdated  EventType = "order.updated"
+	EventDeleted  EventType = "order.deleted"
+	EventRestored EventType = "order.restored"
+	EventPurged   EventType = "order.purged"
+)
+
+// Status changes publish "order.<status>", e.g. order.shipped
+func StatusEventType(status Status) EventType {
+	return EventType("order." + status)
+}
+
+// A change to an order, published to the order event stream in the same
+// transaction as the change itself
+type Event struct {
+	// Assigned by the stream, e.g. "1700000000000-0" for Redis
+	ID        string    `json:"id"`
+	Type      EventType `json:"type"`
+	OrderID   uint64    `json:"order_id"`
+	At        time.Time `json:"at"`
+	RequestID string    `json:"request_id,omitempty"`
+	// The order as it was after the change (before it, for purges)
+	Order Order `json:"order"`
+}
@@ -0,0 +1,101 @@
+package model
+
+import (
+	"errors"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrItemsLocked      = errors.New("Line items can't be changed once an order has shipped or been cancelled")
+	ErrLineItemNotExist = errors.New("Line item does not exist")
+	ErrLineItemExists   = errors.New("Line item already exists")
+)
+
+// Changes to one line item. Nil fields are left as they are.
+type LineItemPatch struct {
+	Quantity *uint  `json:"quantity"`
+	Price    *Money `json:"price"`
+}
+
+// Line items can only be changed until the order ships (or is cancelled,
+// refunded, ...), i.e. while it's still pending or paid
+func (o Order) ItemsEditable() bool {
+	if o.ShippedAt != nil {
+		return false
+	}
+	status := o.CurrentStatus()
+	return status == StatusPending || status == StatusPaid
+}
+
+// Where the item is in LineItems, or -1
+func (o Order) lineItemIndex(itemID uuid.UUID) int {
+	for i, item := range o.LineItems {
+		if item.ItemID == itemID {
+			return i
+		}
+	}
+	return -1
+}
+
+// AddLineItem adds a new item to the order. To order more of an item
+// that's already there, use UpdateLineItem.
+func (o *Order) AddLineItem(item LineItem) error {
+	if !o.ItemsEditable() {
+		return ErrItemsLocked
+	}
+	if o.lineItemIndex(item.ItemID) >= 0 {
+		return ErrLineItemExists
+	}
+
+	items := append(append([]LineItem(nil), o.LineItems...), item)
+	return o.setLineItems(items)
+}
+
+func (o *Order) UpdateLineItem(itemID uuid.UUID, patch LineItemPatch) error {
+	if !o.ItemsEditable() {
+		return ErrItemsLocked
+	}
+	i := o.lineItemIndex(itemID)
+	if i < 0 {
+		return ErrLineItemNotExist
+	}
+
+	items := append([]LineItem(nil), o.LineItems...)
+	if patch.Quantity != nil {
+		items[i].Quantity = *patch.Quantity
+	}
+	if patch.Price != nil {
+		items[i].Price = *patch.Price
+	}
+	return o.setLineItems(items)
+}
+
+// NOTE: The last line item can't be removed, cancel the order instead
+func (o *Order) RemoveLineItem(itemID uuid.UUID) error {
+	if !o.ItemsEditable() {
+		return ErrItemsLocked
+	}
+	i := o.lineItemIndex(itemID)
+	if i < 0 {
+		return ErrLineItemNotExist
+	}
+
+	items := append(append([]LineItem(nil), o.LineItems[:i]...), o.LineItems[i+1:]...)
+	return o.setLineItems(items)
+}
+
+// Replace the line items if the order would still be valid with them.
+// The caller works out the totals again (the repository does on update).
+func (o *Order) setLineItems(items []LineItem) error {
+	errs := ValidateLineItems(items)
+	if len(errs) == 0 {
+		errs = ValidateDiscount(o.Totals.Discount, items)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+
+	o.LineItems = items
+	return nil
+}
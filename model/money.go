@@ -0,0 +1,87 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Currency orders are priced in when none is given, e.g. by clients (and
+// stored orders) from before prices had a currency
+const DefaultCurrency = "USD"
+
+var ErrCurrencyMismatch = errors.New("Currencies don't match")
+
+// Money is an amount in the smallest unit of its currency (e.g. cents),
+// so adding up prices never picks up float rounding errors
+type Money struct {
+	Amount int64 `json:"amount"`
+	// ISO 4217 code, e.g. "USD"
+	Currency string `json:"currency"`
+}
+
+// The zero amount of a currency
+func Zero(currency string) Money {
+	return Money{Currency: currency}
+}
+
+func (m Money) Add(n Money) (Money, error) {
+	if m.Currency != n.Currency {
+		return Money{}, fmt.Errorf("%w: %s and %s", ErrCurrencyMismatch, m.Currency, n.Currency)
+	}
+	return Money{Amount: m.Amount + n.Amount, Currency: m.Currency}, nil
+}
+
+func (m Money) Sub(n Money) (Money, error) {
+	return m.Add(Money{Amount: -n.Amount, Currency: n.Currency})
+}
+
+func (m Money) Mul(n int64) Money {
+	return Money{Amount: m.Amount * n, Currency: m.Currency}
+}
+
+// Rate of the amount in basis points (1/100th of a percent), rounded half
+// up to the nearest minor unit. E.g. 825 is 8.25%.
+func (m Money) Rate(bps uint) Money {
+	amount := (m.Amount*int64(bps) + 5000) / 10000
+	return Money{Amount: amount, Currency: m.Currency}
+}
+
+// Currency codes are 3 upper case letters
+func ValidCurrency(code string) bool {
+	return len(code) == 3 && isUpper(code)
+}
+
+// Whether s is only the letters A to Z
+func isUpper(s string) bool {
+	for _, c := range s {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+	return true
+}
+
+// NOTE: Prices used to be bare numbers (e.g. "price": 250), so those still
+// decode, as an amount in DefaultCurrency
+func (m *Money) UnmarshalJSON(data []byte) error {
+	data = bytes.TrimSpace(data)
+	if len(data) > 0 && (data[0] == '-' || (data[0] >= '0' && data[0] <= '9')) {
+		var amount int64
+		if err := json.Unmarshal(data, &amount); err != nil {
+			return err
+		}
+		*m = Money{Amount: amount, Currency: DefaultCurrency}
+		return nil
+	}
+
+	// Decode into a type without this method, or we'd recurse forever
+	type money Money
+	var v money
+	if err := json.Unmarshal(data, &v); err != nil {
+		return err
+	}
+	*m = Money(v)
+	return nil
+}
@@ -8,19 +8,38 @@ import (
 
 // JSON tags adds a struct tag for JSON type, which allows
 // use to encode/decode to JSON using standard libary
-// NOTE: Using a combination of timestamps to represent
-// the different order statuses. Neat.
+// NOTE: Each status has a timestamp recording when the order
+// moved into it, on top of the current Status itself.
 type Order struct {
-	OrderID     uint64     `json:"order_id"`
-	CustomerID  uuid.UUID  `json:"customer_id"`
-	LineItems   []LineItem `json:"line_items"`
+	OrderID    uint64     `json:"order_id"`
+	CustomerID uuid.UUID  `json:"customer_id"`
+	LineItems  []LineItem `json:"line_items"`
+	// Free text from the customer, e.g. delivery instructions
+	Notes           string   `json:"notes,omitempty"`
+	ShippingAddress *Address `json:"shipping_address,omitempty"`
+	// Only change this through Transition() (see status.go)
+	Status      Status     `json:"status"`
 	CreatedAt   *time.Time `json:"created_at"`
+	PaidAt      *time.Time `json:"paid_at"`
 	ShippedAt   *time.Time `json:"shipped_at"`
+	DeliveredAt *time.Time `json:"delivered_at"`
 	CompletedAt *time.Time `json:"completed_at"`
+	CancelledAt *time.Time `json:"cancelled_at"`
+	RefundedAt  *time.Time `json:"refunded_at"`
+	ReturnedAt  *time.Time `json:"returned_at"`
+	// Set while the order is in the trash, see order.Repo.DeleteByID
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// Worked out from the line items whenever they change (see totals.go)
+	Totals Totals `json:"totals"`
+	// Bumped by the repository on every update. Used as the order's ETag
+	Revision uint64 `json:"revision"`
 }
 
 type LineItem struct {
 	ItemID   uuid.UUID `json:"item_id"`
 	Quantity uint      `json:"quantity"`
-	Price    uint      `json:"price"`
+	// Price of one item
+	Price Money `json:"price"`
+	// Price * Quantity, worked out by CalculateTotals
+	Subtotal Money `json:"subtotal"`
 }
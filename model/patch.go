@@ -0,0 +1,111 @@
+package model
+
+import (
+	"time"
+)
+
+// ApplyPatch changes o to match patched, a copy of o with a client's
+// changes applied (e.g. by a JSON Merge Patch). Only the mutable fields
+// can be changed:
+//   - line_items, while ItemsEditable
+//   - notes and shipping_address
+//   - totals.discount
+//   - status, through Transition
+//
+// Changing anything else (order_id, customer_id, the timestamps, ...)
+// returns a ValidationError, as does an invalid new value.
+func (o *Order) ApplyPatch(patched Order, now time.Time) error {
+	var errs ValidationError
+
+	if patched.OrderID != o.OrderID {
+		errs.add("order_id", "is read-only")
+	}
+	if patched.CustomerID != o.CustomerID {
+		errs.add("customer_id", "is read-only")
+	}
+	if patched.Revision != o.Revision {
+		errs.add("revision", "is read-only")
+	}
+
+	// NOTE: Status timestamps are set by Transition, not by clients
+	timestamps := []struct {
+		field         string
+		current, next *time.Time
+	}{
+		{"created_at", o.CreatedAt, patched.CreatedAt},
+		{"paid_at", o.PaidAt, patched.PaidAt},
+		{"shipped_at", o.ShippedAt, patched.ShippedAt},
+		{"delivered_at", o.DeliveredAt, patched.DeliveredAt},
+		{"completed_at", o.CompletedAt, patched.CompletedAt},
+		{"cancelled_at", o.CancelledAt, patched.CancelledAt},
+		{"refunded_at", o.RefundedAt, patched.RefundedAt},
+		{"returned_at", o.ReturnedAt, patched.ReturnedAt},
+		{"deleted_at", o.DeletedAt, patched.DeletedAt},
+	}
+	for _, ts := range timestamps {
+		if !sameTime(ts.current, ts.next) {
+			errs.add(ts.field, "is read-only")
+		}
+	}
+
+	// Everything in totals but the discount is worked out by the server
+	discount := patched.Totals.Discount
+	patched.Totals.Discount = o.Totals.Discount
+	if patched.Totals != o.Totals {
+		errs.add("totals", "is read-only, except for totals.discount")
+	}
+
+	itemsChanged := !sameLineItems(o.LineItems, patched.LineItems)
+	if itemsChanged {
+		if !o.ItemsEditable() {
+			return ErrItemsLocked
+		}
+		errs = append(errs, ValidateLineItems(patched.LineItems)...)
+	}
+	if itemsChanged || discount != o.Totals.Discount {
+		errs = append(errs, ValidateDiscount(discount, patched.LineItems)...)
+	}
+
+	errs = append(errs, ValidateNotes(patched.Notes)...)
+	if patched.ShippingAddress != nil {
+		errs = append(errs, patched.ShippingAddress.Validate("shipping_address")...)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	// Only move through the state machine once we know the rest is valid
+	if status := patched.Status; status != o.CurrentStatus() {
+		if err := o.Transition(status, now); err != nil {
+			return err
+		}
+	}
+
+	o.LineItems = patched.LineItems
+	o.Notes = patched.Notes
+	o.ShippingAddress = patched.ShippingAddress
+	o.Totals.Discount = discount
+	return nil
+}
+
+func sameTime(a, b *time.Time) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return a.Equal(*b)
+}
+
+// Compare line items by what clients set, ignoring the Subtotals we work
+// out from them
+func sameLineItems(a, b []LineItem) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].ItemID != b[i].ItemID || a[i].Quantity != b[i].Quantity || a[i].Price != b[i].Price {
+			return false
+		}
+	}
+	return true
+}
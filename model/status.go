@@ -0,0 +1,149 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+type Status string
+
+const (
+	StatusPending   Status = "pending"
+	StatusPaid      Status = "paid"
+	StatusShipped   Status = "shipped"
+	StatusDelivered Status = "delivered"
+	StatusCompleted Status = "completed"
+	StatusCancelled Status = "cancelled"
+	StatusRefunded  Status = "refunded"
+	StatusReturned  Status = "returned"
+)
+
+// All the statuses an order can be in
+var Statuses = []Status{
+	StatusPending,
+	StatusPaid,
+	StatusShipped,
+	StatusDelivered,
+	StatusCompleted,
+	StatusCancelled,
+	StatusRefunded,
+	StatusReturned,
+}
+
+// The order lifecycle: which statuses an order may move to from each
+// status. Anything not listed here is an illegal transition.
+// NOTE: pending -> shipped and shipped -> completed are kept so clients
+// written before paid/delivered existed keep working.
+var transitions = map[Status][]Status{
+	StatusPending:   {StatusPaid, StatusShipped, StatusCancelled},
+	StatusPaid:      {StatusShipped, StatusCancelled, StatusRefunded},
+	StatusShipped:   {StatusDelivered, StatusCompleted, StatusReturned},
+	StatusDelivered: {StatusCompleted, StatusReturned},
+	StatusCompleted: {StatusReturned},
+	StatusCancelled: {StatusRefunded},
+	StatusReturned:  {StatusRefunded},
+	StatusRefunded:  {},
+}
+
+func (s Status) Valid() bool {
+	_, ok := transitions[s]
+	return ok
+}
+
+// The statuses an order in status s may move to next
+func (s Status) Next() []Status {
+	return transitions[s]
+}
+
+func (s Status) CanTransitionTo(to Status) bool {
+	for _, next := range transitions[s] {
+		if next == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Returned by Transition when the requested status change isn't allowed
+type TransitionError struct {
+	From    Status
+	To      Status
+	Allowed []Status
+}
+
+func (e *TransitionError) Error() string {
+	if !e.To.Valid() {
+		return fmt.Sprintf("Unknown order status %q", e.To)
+	}
+
+	allowed := make([]string, len(e.Allowed))
+	for i, s := range e.Allowed {
+		allowed[i] = string(s)
+	}
+	if len(allowed) == 0 {
+		return fmt.Sprintf("Cannot change order status from %q to %q: %q is final", e.From, e.To, e.From)
+	}
+
+	return fmt.Sprintf(
+		"Cannot change order status from %q to %q (allowed: %s)",
+		e.From, e.To, strings.Join(allowed, ", "),
+	)
+}
+
+// CurrentStatus returns the order's Status. Orders stored before Status
+// existed only have timestamps, so we work it out from those.
+func (o Order) CurrentStatus() Status {
+	if o.Status != "" {
+		return o.Status
+	}
+
+	switch {
+	case o.CompletedAt != nil:
+		return StatusCompleted
+	case o.ShippedAt != nil:
+		return StatusShipped
+	default:
+		return StatusPending
+	}
+}
+
+// Transition moves the order into status 'to' at time 'at', recording
+// the matching timestamp. Illegal transitions return a *TransitionError.
+func (o *Order) Transition(to Status, at time.Time) error {
+	from := o.CurrentStatus()
+	if !from.CanTransitionTo(to) {
+		return &TransitionError{
+			From:    from,
+			To:      to,
+			Allowed: from.Next(),
+		}
+	}
+
+	o.Status = to
+	*o.timestampFor(to) = &at
+
+	return nil
+}
+
+// The timestamp field that records when the order entered status s
+func (o *Order) timestampFor(s Status) **time.Time {
+	switch s {
+	case StatusPaid:
+		return &o.PaidAt
+	case StatusShipped:
+		return &o.ShippedAt
+	case StatusDelivered:
+		return &o.DeliveredAt
+	case StatusCompleted:
+		return &o.CompletedAt
+	case StatusCancelled:
+		return &o.CancelledAt
+	case StatusRefunded:
+		return &o.RefundedAt
+	case StatusReturned:
+		return &o.ReturnedAt
+	default:
+		return &o.CreatedAt
+	}
+}
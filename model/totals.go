@@ -0,0 +1,63 @@
+package model
+
+// Totals are worked out by the server from the line items, the discount
+// and the tax rate (see CalculateTotals), and stored with the order
+type Totals struct {
+	// Sum of the line item subtotals
+	Subtotal Money `json:"subtotal"`
+	Discount Money `json:"discount"`
+	// In basis points, e.g. 825 is 8.25%. Charged after the discount.
+	TaxRate uint  `json:"tax_rate_bps"`
+	Tax     Money `json:"tax"`
+	Total   Money `json:"total"`
+}
+
+// The currency the order is priced in: its first line item's
+func (o Order) Currency() string {
+	if len(o.LineItems) > 0 && o.LineItems[0].Price.Currency != "" {
+		return o.LineItems[0].Price.Currency
+	}
+	if o.Totals.Discount.Currency != "" {
+		return o.Totals.Discount.Currency
+	}
+	return DefaultCurrency
+}
+
+// CalculateTotals works out each line item's subtotal and the order's
+// Totals, keeping the Discount and TaxRate already set. Returns
+// ErrCurrencyMismatch if the prices aren't all in the same currency.
+func (o *Order) CalculateTotals() error {
+	currency := o.Currency()
+
+	subtotal := Zero(currency)
+	for i := range o.LineItems {
+		item := &o.LineItems[i]
+		item.Subtotal = item.Price.Mul(int64(item.Quantity))
+
+		var err error
+		subtotal, err = subtotal.Add(item.Subtotal)
+		if err != nil {
+			return err
+		}
+	}
+
+	totals := o.Totals
+	if totals.Discount.Currency == "" {
+		totals.Discount = Zero(currency)
+	}
+	totals.Subtotal = subtotal
+
+	// Tax is charged on what the customer actually pays for the items
+	taxable, err := subtotal.Sub(totals.Discount)
+	if err != nil {
+		return err
+	}
+	totals.Tax = taxable.Rate(totals.TaxRate)
+	totals.Total, err = taxable.Add(totals.Tax)
+	if err != nil {
+		return err
+	}
+
+	o.Totals = totals
+	return nil
+}
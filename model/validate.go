@@ -0,0 +1,128 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Most of one item a single line item can order
+	MaxQuantity = 10_000
+	// Highest price of a single item, in the currency's smallest unit
+	// (e.g. cents)
+	MaxPrice = 100_000_000
+	// Most line items an order can have
+	MaxLineItems = 100
+)
+
+// FieldError says what's wrong with one field. Field is a path from the
+// root of the value being validated, e.g. "line_items[2].quantity".
+type FieldError struct {
+	Field   string
+	Message string
+}
+
+// ValidationError holds every problem found with a value, so clients can
+// fix them all at once instead of one request at a time
+type ValidationError []FieldError
+
+func (e ValidationError) Error() string {
+	problems := make([]string, len(e))
+	for i, fe := range e {
+		problems[i] = fe.Field + " " + fe.Message
+	}
+	return "Invalid: " + strings.Join(problems, "; ")
+}
+
+func (e *ValidationError) add(field, format string, args ...any) {
+	*e = append(*e, FieldError{Field: field, Message: fmt.Sprintf(format, args...)})
+}
+
+// Join a field onto the path of the value it's in. An empty path is the
+// root of the value being validated.
+func fieldPath(path, field string) string {
+	if path == "" {
+		return field
+	}
+	return path + "." + field
+}
+
+// Validate checks a single line item. path is where the item sits in the
+// value being validated, e.g. "line_items[0]", or "" if it's the root.
+func (li LineItem) Validate(path string) ValidationError {
+	var errs ValidationError
+	if li.ItemID == uuid.Nil {
+		errs.add(fieldPath(path, "item_id"), "is required")
+	}
+	if li.Quantity == 0 || li.Quantity > MaxQuantity {
+		errs.add(fieldPath(path, "quantity"), "must be between 1 and %d", MaxQuantity)
+	}
+	// NOTE: Free items (price 0) are allowed, e.g. promotional extras
+	if li.Price.Amount < 0 || li.Price.Amount > MaxPrice {
+		errs.add(fieldPath(path, "price.amount"), "must be between 0 and %d", MaxPrice)
+	}
+	if !ValidCurrency(li.Price.Currency) {
+		errs.add(fieldPath(path, "price.currency"), "must be an ISO 4217 currency code")
+	}
+	return errs
+}
+
+// ValidateLineItems checks an order's line items: there must be at least
+// one, not too many, each valid, all in the same currency, and no item
+// listed twice (that's what Quantity is for).
+func ValidateLineItems(items []LineItem) ValidationError {
+	var errs ValidationError
+	if len(items) == 0 {
+		errs.add("line_items", "must not be empty")
+	} else if len(items) > MaxLineItems {
+		errs.add("line_items", "must have at most %d items", MaxLineItems)
+	}
+
+	seen := make(map[uuid.UUID]int, len(items))
+	for i, item := range items {
+		path := fmt.Sprintf("line_items[%d]", i)
+		errs = append(errs, item.Validate(path)...)
+
+		if i > 0 && item.Price.Currency != items[0].Price.Currency {
+			errs.add(path+".price.currency", "must match line_items[0].price.currency (%s)", items[0].Price.Currency)
+		}
+
+		if item.ItemID == uuid.Nil {
+			continue
+		}
+		if first, dup := seen[item.ItemID]; dup {
+			errs.add(path+".item_id", "duplicates line_items[%d].item_id", first)
+		} else {
+			seen[item.ItemID] = i
+		}
+	}
+
+	return errs
+}
+
+// ValidateDiscount checks discount can be taken off an order with these
+// (already valid) line items
+func ValidateDiscount(discount Money, items []LineItem) ValidationError {
+	var errs ValidationError
+	if len(items) == 0 {
+		return errs
+	}
+
+	currency := items[0].Price.Currency
+	if discount.Currency != currency {
+		errs.add("discount.currency", "must match the line items' currency (%s)", currency)
+		return errs
+	}
+
+	var subtotal int64
+	for _, item := range items {
+		subtotal += item.Price.Amount * int64(item.Quantity)
+	}
+	if discount.Amount < 0 || discount.Amount > subtotal {
+		errs.add("discount.amount", "must be between 0 and the order subtotal (%d)", subtotal)
+	}
+
+	return errs
+}
@@ -0,0 +1,71 @@
+package problem
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+const ContentType = "application/problem+json"
+
+// "about:blank" means the problem has no more meaning than its HTTP status
+const TypeBlank = "about:blank"
+
+// Problem is an RFC 7807 problem details body, so clients can tell errors
+// apart by Type instead of parsing messages.
+// REF: https://www.rfc-editor.org/rfc/rfc7807
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	// The request path the problem happened on
+	Instance string `json:"instance,omitempty"`
+	// Which parts of the request were wrong, for validation problems
+	Errors []FieldError `json:"errors,omitempty"`
+	// Matches the X-Request-Id header, to find the request in the logs
+	RequestID string `json:"request_id,omitempty"`
+}
+
+// One invalid part of a request, e.g. a body field or query parameter
+type FieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// New creates a plain problem, titled with the status text
+func New(status int, detail string) *Problem {
+	return &Problem{
+		Type:   TypeBlank,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	}
+}
+
+// NOTE: Problem is an error so handlers can return one from anywhere
+// (e.g. a request parser) and have it written as is
+func (p *Problem) Error() string {
+	if p.Detail != "" {
+		return p.Detail
+	}
+	return p.Title
+}
+
+// Write sends p to the client, filling in the request's path and ID
+func Write(w http.ResponseWriter, r *http.Request, p *Problem) {
+	if p.Instance == "" {
+		p.Instance = r.URL.Path
+	}
+	if p.RequestID == "" {
+		p.RequestID = middleware.GetReqID(r.Context())
+	}
+
+	w.Header().Set("Content-Type", ContentType)
+	w.WriteHeader(p.Status)
+	if err := json.NewEncoder(w).Encode(p); err != nil {
+		fmt.Println("Failed to marshal:", err)
+	}
+}
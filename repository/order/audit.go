@@ -0,0 +1,61 @@
+package order
+
+import (
+	"context"
+	"time"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+// Who is making a change, passed down to the repository via the request
+// Context so every write can record it in the order's history
+type AuditInfo struct {
+	Actor     string
+	RequestID string
+}
+
+// Used when nobody told us who's making the change
+const UnknownActor = "unknown"
+
+// NOTE: An unexported key type means no other package can collide with
+// (or overwrite) our Context value
+type auditInfoKey struct{}
+
+func WithAuditInfo(ctx context.Context, info AuditInfo) context.Context {
+	return context.WithValue(ctx, auditInfoKey{}, info)
+}
+
+func auditInfoFrom(ctx context.Context) AuditInfo {
+	info, _ := ctx.Value(auditInfoKey{}).(AuditInfo)
+	if info.Actor == "" {
+		info.Actor = UnknownActor
+	}
+	return info
+}
+
+// Build the history entry for a change from 'prev' (nil for a new
+// order) to 'order'
+func newAuditEntry(ctx context.Context, action model.AuditAction, prev *model.Order, order model.Order) model.AuditEntry {
+	info := auditInfoFrom(ctx)
+	entry := model.AuditEntry{
+		Action:    action,
+		Actor:     info.Actor,
+		At:        time.Now().UTC(),
+		To:        order.CurrentStatus(),
+		Revision:  order.Revision,
+		RequestID: info.RequestID,
+	}
+	if prev != nil {
+		entry.From = prev.CurrentStatus()
+	}
+
+	switch {
+	case action == model.AuditDeleted, action == model.AuditRestored, action == model.AuditPurged:
+		// Moving in and out of the trash doesn't change the status
+		entry.To = ""
+	case action == model.AuditUpdated && entry.From != entry.To:
+		entry.Action = model.AuditStatusChanged
+	}
+
+	return entry
+}
@@ -0,0 +1,166 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Every node holding data: each master of a cluster, each shard of a
+// ring, or just the one node otherwise. Used for commands like SCAN that
+// only see the keys on the node they're sent to.
+func (r *RedisRepo) nodes(ctx context.Context) ([]*redis.Client, error) {
+	var mu sync.Mutex
+	var nodes []*redis.Client
+	collect := func(ctx context.Context, node *redis.Client) error {
+		mu.Lock()
+		defer mu.Unlock()
+		nodes = append(nodes, node)
+		return nil
+	}
+
+	var err error
+	switch c := r.Client.(type) {
+	case *redis.Client:
+		return []*redis.Client{c}, nil
+	case *redis.ClusterClient:
+		err = c.ForEachMaster(ctx, collect)
+	case *redis.Ring:
+		err = c.ForEachShard(ctx, collect)
+	default:
+		return nil, fmt.Errorf("Unsupported redis client %T", r.Client)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Failed to list redis nodes: %w", err)
+	}
+	return nodes, nil
+}
+
+// SCAN every node for keys matching match, calling fn with each batch
+func (r *RedisRepo) scanKeys(ctx context.Context, match string, fn func(keys []string) error) error {
+	nodes, err := r.nodes(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, node := range nodes {
+		var cursor uint64
+		for {
+			keys, next, err := node.Scan(ctx, cursor, match, 100).Result()
+			if err != nil {
+				return fmt.Errorf("Failed to scan keys: %w", err)
+			}
+			if len(keys) > 0 {
+				if err := fn(keys); err != nil {
+					return err
+				}
+			}
+
+			// NOTE: Unlike our own cursors, Scan is done when it returns 0
+			cursor = next
+			if cursor == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// The keys used before they all started with keyTag. Patterns are SCANned
+// for, the rest are fixed keys.
+var (
+	untaggedKeyPatterns = []string{"order:*", "customer:*:orders", "orders:status:*"}
+	untaggedKeys        = []string{"orders:created", "orders:deleted", "orders:deleted_at", "orders:events"}
+)
+
+// Whether any of the fixed keys used before keys started with keyTag
+// still exist, i.e. MigrateKeyLayout hasn't been run on this data. Orders
+// under those names are invisible until it is. Only the fixed keys are
+// checked, so it's cheap enough for every startup: anything that ever
+// stored an order wrote the created-order index.
+func (r *RedisRepo) HasUntaggedKeys(ctx context.Context) (bool, error) {
+	for _, key := range untaggedKeys {
+		// One key at a time, they're in different slots on a cluster
+		n, err := r.Client.Exists(ctx, key).Result()
+		if err != nil {
+			return false, fmt.Errorf("Failed to check key %s: %w", key, err)
+		}
+		if n > 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HasKeyTag reports whether key hashes to the same cluster slot as every
+// other key we use, so it can share their transactions. Only the first
+// {...} in a key is hashed.
+// REF: https://redis.io/docs/reference/cluster-spec/#hash-tags
+func HasKeyTag(key string) bool {
+	start := strings.IndexByte(key, '{')
+	if start < 0 {
+		return false
+	}
+	end := strings.IndexByte(key[start+1:], '}')
+	if end < 0 {
+		return false
+	}
+	return key[start:start+end+2] == strings.TrimSuffix(keyTag, ":")
+}
+
+var ErrMigrateNeedsSingleNode = errors.New("Key migration needs a single redis node")
+
+// MigrateKeyLayout renames every key written before keys started with
+// keyTag to its tagged name. Run it against the single node the data was
+// written to, before moving the data to a cluster. It's safe to run more
+// than once, and keys whose tagged name is already taken are left alone.
+// Returns how many keys were renamed.
+func (r *RedisRepo) MigrateKeyLayout(ctx context.Context) (int, error) {
+	// NOTE: On a cluster or ring the tagged name can belong to another
+	// node, and RENAME can't move a key between nodes
+	client, ok := r.Client.(*redis.Client)
+	if !ok {
+		return 0, ErrMigrateNeedsSingleNode
+	}
+
+	var renamed int
+	rename := func(keys []string) error {
+		for _, key := range keys {
+			// The fixed keys might never have been written, and RENAMENX
+			// errors for a missing key
+			n, err := client.Exists(ctx, key).Result()
+			if err != nil {
+				return fmt.Errorf("Failed to check key %s: %w", key, err)
+			}
+			if n == 0 {
+				continue
+			}
+
+			ok, err := client.RenameNX(ctx, key, keyTag+key).Result()
+			if err != nil {
+				return fmt.Errorf("Failed to rename key %s: %w", key, err)
+			}
+			if !ok {
+				fmt.Println("Key already migrated, leaving it:", key)
+				continue
+			}
+			renamed++
+		}
+		return nil
+	}
+
+	for _, pattern := range untaggedKeyPatterns {
+		if err := r.scanKeys(ctx, pattern, rename); err != nil {
+			return renamed, err
+		}
+	}
+	if err := rename(untaggedKeys); err != nil {
+		return renamed, err
+	}
+
+	return renamed, nil
+}
@@ -0,0 +1,101 @@
+package order
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// indexPos is where an order sits in the created-order index. Orders are
+// sorted by CreatedAt first, then by OrderID to break ties between orders
+// created in the same microsecond.
+type indexPos struct {
+	Score int64 // CreatedAt in Unix microseconds
+	ID    uint64
+}
+
+// NOTE: Microseconds keep the score well within the 2^53 range a float64
+// (what Redis uses for ZSET scores) can represent exactly.
+func positionOf(order model.Order) indexPos {
+	var score int64
+	if order.CreatedAt != nil {
+		score = order.CreatedAt.UnixMicro()
+	}
+	return indexPos{Score: score, ID: order.OrderID}
+}
+
+// The created-order index scores a page is limited to, derived from the
+// page's CreatedAfter/CreatedBefore filters. Both bounds are exclusive.
+type scoreRange struct {
+	After, Before       int64
+	HasAfter, HasBefore bool
+}
+
+func rangeOf(page FindAllPage) scoreRange {
+	var rng scoreRange
+	if page.CreatedAfter != nil {
+		rng.After, rng.HasAfter = page.CreatedAfter.UnixMicro(), true
+	}
+	if page.CreatedBefore != nil {
+		rng.Before, rng.HasBefore = page.CreatedBefore.UnixMicro(), true
+	}
+	return rng
+}
+
+func (rng scoreRange) contains(score int64) bool {
+	return (!rng.HasAfter || score > rng.After) && (!rng.HasBefore || score < rng.Before)
+}
+
+func (p indexPos) less(q indexPos) bool {
+	if p.Score != q.Score {
+		return p.Score < q.Score
+	}
+	return p.ID < q.ID
+}
+
+// Zero-pad the ID so Redis' lexicographic ordering of equal-score members
+// matches numeric OrderID ordering
+func indexMember(id uint64) string {
+	return fmt.Sprintf("%020d", id)
+}
+
+func parseIndexMember(member string) (uint64, error) {
+	return strconv.ParseUint(member, 10, 64)
+}
+
+// The cursor handed to clients is the position of the last order on the
+// page. It's base64 encoded so clients treat it as an opaque token.
+func encodeCursor(p indexPos) string {
+	raw := fmt.Sprintf("%d.%d", p.Score, p.ID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func decodeCursor(cursor string) (indexPos, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return indexPos{}, ErrInvalidCursor
+	}
+
+	scoreStr, idStr, found := strings.Cut(string(raw), ".")
+	if !found {
+		return indexPos{}, ErrInvalidCursor
+	}
+
+	score, err := strconv.ParseInt(scoreStr, 10, 64)
+	if err != nil {
+		return indexPos{}, ErrInvalidCursor
+	}
+
+	id, err := strconv.ParseUint(idStr, 10, 64)
+	if err != nil {
+		return indexPos{}, ErrInvalidCursor
+	}
+
+	return indexPos{Score: score, ID: id}, nil
+}
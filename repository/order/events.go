@@ -0,0 +1,88 @@
+package order
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+// Default name and approximate max length of the order event stream
+const (
+	DefaultEventStream       = keyTag + "events"
+	DefaultEventStreamMaxLen = 10000
+)
+
+// Every change we audit is also published as an event, so derive the
+// event from the audit entry to keep the two in agreement
+func newEvent(entry model.AuditEntry, order model.Order) model.Event {
+	event := model.Event{
+		OrderID:   order.OrderID,
+		At:        entry.At,
+		RequestID: entry.RequestID,
+		Order:     order,
+	}
+
+	switch entry.Action {
+	case model.AuditCreated:
+		event.Type = model.EventCreated
+	case model.AuditStatusChanged:
+		event.Type = model.StatusEventType(entry.To)
+	case model.AuditDeleted:
+		event.Type = model.EventDeleted
+	case model.AuditRestored:
+		event.Type = model.EventRestored
+	case model.AuditPurged:
+		event.Type = model.EventPurged
+	default:
+		event.Type = model.EventUpdated
+	}
+
+	return event
+}
+
+// Returned for event IDs that aren't in "<milliseconds>-<sequence>" form
+var ErrInvalidEventID = errors.New("Invalid event ID")
+
+// The ID to read from to get every event still in the stream
+const FirstEventID = "0-0"
+
+// Event IDs look like "1700000000000-0": the millisecond the event was
+// added, plus a sequence number for events added in the same millisecond
+type eventID struct {
+	Ms, Seq uint64
+}
+
+func parseEventID(id string) (eventID, error) {
+	msStr, seqStr, found := strings.Cut(id, "-")
+	if !found {
+		// Like Redis, a bare millisecond means sequence 0
+		seqStr = "0"
+	}
+
+	ms, err := strconv.ParseUint(msStr, 10, 64)
+	if err != nil {
+		return eventID{}, ErrInvalidEventID
+	}
+	seq, err := strconv.ParseUint(seqStr, 10, 64)
+	if err != nil {
+		return eventID{}, ErrInvalidEventID
+	}
+
+	return eventID{Ms: ms, Seq: seq}, nil
+}
+
+func (id eventID) after(other eventID) bool {
+	if id.Ms != other.Ms {
+		return id.Ms > other.Ms
+	}
+	return id.Seq > other.Seq
+}
+
+// ValidEventID reports whether id can be passed to ReadEvents, e.g. a
+// Last-Event-ID header sent by a reconnecting client
+func ValidEventID(id string) bool {
+	_, err := parseEventID(id)
+	return err == nil
+}
@@ -0,0 +1,282 @@
+package order
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/redis/go-redis/v9"
+
+	"github.com/gaylonalfano/go-redis-crud/codec"
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+// How RedisRepo lays out each order:{id} key
+type Layout string
+
+const (
+	// The whole order as one string (the original layout), encoded with
+	// RedisRepo.Codec. Named for the codec it started out with.
+	LayoutJSON Layout = "json"
+	// A hash with a field per Order field, so an update only writes the
+	// fields that changed. Line items, totals and the shipping address
+	// are each stored as a JSON field.
+	LayoutHash Layout = "hash"
+)
+
+// NOTE: Both layouts use the same keys, so a Redis database must only
+// hold orders in one of them. Reading the other gets a WRONGTYPE error.
+func (r *RedisRepo) hashLayout() bool {
+	return r.Layout == LayoutHash
+}
+
+// Read and decode one order with c (the client, or a Tx while WATCHing).
+// Returns ErrNotExist if there's no such order.
+func (r *RedisRepo) getOrder(ctx context.Context, c redis.Cmdable, key string) (model.Order, error) {
+	if r.hashLayout() {
+		fields, err := c.HGetAll(ctx, key).Result()
+		if err != nil {
+			return model.Order{}, fmt.Errorf("Failed to get order: %w", err)
+		}
+		// NOTE: HGETALL on a missing key is just an empty hash
+		if len(fields) == 0 {
+			return model.Order{}, ErrNotExist
+		}
+		return decodeHash(fields)
+	}
+
+	// Check whether the error is a Redis error, so we can then
+	// return our custom error.
+	value, err := c.Get(ctx, key).Result()
+	if errors.Is(err, redis.Nil) {
+		return model.Order{}, ErrNotExist
+	} else if err != nil {
+		return model.Order{}, fmt.Errorf("Failed to get order: %w", err)
+	}
+	return decodeOrder(value)
+}
+
+// Like getOrder, but treating an order that's in the trash as not existing
+func (r *RedisRepo) getLiveOrder(ctx context.Context, c redis.Cmdable, key string) (model.Order, error) {
+	order, err := r.getOrder(ctx, c, key)
+	if err != nil {
+		return model.Order{}, err
+	}
+	if order.DeletedAt != nil {
+		return model.Order{}, ErrNotExist
+	}
+	return order, nil
+}
+
+// Read several orders in one round trip. Orders that don't exist are nil.
+func (r *RedisRepo) getOrders(ctx context.Context, c redis.Cmdable, keys []string) ([]*model.Order, error) {
+	orders := make([]*model.Order, len(keys))
+
+	if r.hashLayout() {
+		// There's no multi-key HGETALL, so pipeline one per order
+		cmds := make([]*redis.MapStringStringCmd, len(keys))
+		_, err := c.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				cmds[i] = pipe.HGetAll(ctx, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get order values from keys: %w", err)
+		}
+
+		for i, cmd := range cmds {
+			if len(cmd.Val()) == 0 {
+				continue
+			}
+			order, err := decodeHash(cmd.Val())
+			if err != nil {
+				return nil, err
+			}
+			orders[i] = &order
+		}
+		return orders, nil
+	}
+
+	// We only have the IDs. Now time to get all the full values for each key
+	xs, err := c.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to get order values from keys: %w", err)
+	}
+
+	for i, x := range xs {
+		// A nil value means the key doesn't exist
+		x, ok := x.(string)
+		if !ok {
+			continue
+		}
+
+		// Then, Unmarshal (decode) string (x) into an Order struct
+		order, err := decodeOrder(x)
+		if err != nil {
+			return nil, err
+		}
+		orders[i] = &order
+	}
+	return orders, nil
+}
+
+// Queue writing an order onto a MULTI/EXEC. prev is the stored version
+// being replaced, or nil for a new order. With the hash layout only the
+// fields that differ from prev are written.
+func (r *RedisRepo) queueWriteOrder(ctx context.Context, pipe redis.Pipeliner, key string, prev *model.Order, order model.Order) error {
+	if !r.hashLayout() {
+		data, err := codec.Encode(r.codec(), order)
+		if err != nil {
+			return err
+		}
+		if r.CompressAbove > 0 {
+			data, err = codec.Compress(data, r.CompressAbove)
+			if err != nil {
+				return err
+			}
+		}
+		if prev == nil {
+			pipe.Set(ctx, key, string(data), 0)
+		} else {
+			pipe.SetXX(ctx, key, string(data), 0)
+		}
+		return nil
+	}
+
+	fields, err := encodeHash(order)
+	if err != nil {
+		return err
+	}
+
+	var removed []string
+	if prev != nil {
+		prevFields, err := encodeHash(*prev)
+		if err != nil {
+			return err
+		}
+		for name, value := range prevFields {
+			if _, ok := fields[name]; !ok {
+				removed = append(removed, name)
+			} else if fields[name] == value {
+				delete(fields, name)
+			}
+		}
+	}
+
+	// NOTE: HSET with no fields is an error, not a no-op
+	if len(fields) > 0 {
+		pipe.HSet(ctx, key, fields)
+	}
+	if len(removed) > 0 {
+		pipe.HDel(ctx, key, removed...)
+	}
+	return nil
+}
+
+// The order's optional timestamps by hash field name
+func timestampFields(order *model.Order) map[string]**time.Time {
+	return map[string]**time.Time{
+		"created_at":   &order.CreatedAt,
+		"paid_at":      &order.PaidAt,
+		"shipped_at":   &order.ShippedAt,
+		"delivered_at": &order.DeliveredAt,
+		"completed_at": &order.CompletedAt,
+		"cancelled_at": &order.CancelledAt,
+		"refunded_at":  &order.RefundedAt,
+		"returned_at":  &order.ReturnedAt,
+		"deleted_at":   &order.DeletedAt,
+	}
+}
+
+// The hash fields for an order. Empty optional fields are left out, so
+// clearing one (e.g. DeletedAt on restore) deletes its field.
+func encodeHash(order model.Order) (map[string]string, error) {
+	fields := map[string]string{
+		"order_id":    strconv.FormatUint(order.OrderID, 10),
+		"customer_id": order.CustomerID.String(),
+		"status":      string(order.Status),
+		"revision":    strconv.FormatUint(order.Revision, 10),
+	}
+	if order.Notes != "" {
+		fields["notes"] = order.Notes
+	}
+	for name, t := range timestampFields(&order) {
+		if *t != nil {
+			fields[name] = (*t).Format(time.RFC3339Nano)
+		}
+	}
+
+	nested := map[string]any{
+		"line_items": order.LineItems,
+		"totals":     order.Totals,
+	}
+	if order.ShippingAddress != nil {
+		nested["shipping_address"] = order.ShippingAddress
+	}
+	for name, value := range nested {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to encode order %s: %w", name, err)
+		}
+		fields[name] = string(data)
+	}
+
+	return fields, nil
+}
+
+func decodeHash(fields map[string]string) (model.Order, error) {
+	var order model.Order
+	var err error
+
+	order.OrderID, err = strconv.ParseUint(fields["order_id"], 10, 64)
+	if err != nil {
+		return model.Order{}, fmt.Errorf("Failed to decode order_id: %w", err)
+	}
+	order.CustomerID, err = uuid.Parse(fields["customer_id"])
+	if err != nil {
+		return model.Order{}, fmt.Errorf("Failed to decode customer_id: %w", err)
+	}
+	order.Revision, err = strconv.ParseUint(fields["revision"], 10, 64)
+	if err != nil {
+		return model.Order{}, fmt.Errorf("Failed to decode revision: %w", err)
+	}
+	order.Status = model.Status(fields["status"])
+	order.Notes = fields["notes"]
+
+	for name, t := range timestampFields(&order) {
+		value, ok := fields[name]
+		if !ok {
+			continue
+		}
+		parsed, err := time.Parse(time.RFC3339Nano, value)
+		if err != nil {
+			return model.Order{}, fmt.Errorf("Failed to decode %s: %w", name, err)
+		}
+		*t = &parsed
+	}
+
+	nested := map[string]any{
+		"line_items":       &order.LineItems,
+		"totals":           &order.Totals,
+		"shipping_address": &order.ShippingAddress,
+	}
+	for name, value := range nested {
+		data, ok := fields[name]
+		if !ok {
+			continue
+		}
+		if err := json.Unmarshal([]byte(data), value); err != nil {
+			return model.Order{}, fmt.Errorf("Failed to decode order %s: %w", name, err)
+		}
+	}
+
+	if err := normalizeOrder(&order); err != nil {
+		return model.Order{}, err
+	}
+	return order, nil
+}
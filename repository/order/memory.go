@@ -0,0 +1,551 @@
+package order
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+	"github.com/google/uuid"
+)
+
+// MemoryRepo keeps orders in a plain Go map so the whole service can run
+// (and handlers can be exercised) without a Redis server.
+// NOTE: The mutex makes it safe to share across request Go routines.
+type MemoryRepo struct {
+	mu     sync.RWMutex
+	orders map[uint64]model.Order
+	// Play the role of the created-order ZSETs that RedisRepo pages over
+	index     sortedIndex
+	customers map[uuid.UUID]sortedIndex
+	statuses  map[model.Status]sortedIndex
+	trash     sortedIndex
+	history   map[uint64][]model.AuditEntry
+
+	// In-process stand-in for the Redis event stream, trimmed to roughly
+	// EventStreamMaxLen entries (DefaultEventStreamMaxLen when zero)
+	EventStreamMaxLen int64
+	events            []model.Event
+	lastEventMs       int64
+	lastEventSeq      uint64
+	// Closed (and replaced) whenever an event is added, waking up any
+	// blocked ReadEvents calls
+	newEvents chan struct{}
+}
+
+func NewMemoryRepo() *MemoryRepo {
+	return &MemoryRepo{
+		orders:    make(map[uint64]model.Order),
+		customers: make(map[uuid.UUID]sortedIndex),
+		statuses:  make(map[model.Status]sortedIndex),
+		history:   make(map[uint64][]model.AuditEntry),
+		newEvents: make(chan struct{}),
+	}
+}
+
+// sortedIndex is kept sorted by (CreatedAt, OrderID), like a ZSET
+type sortedIndex []indexPos
+
+func (idx sortedIndex) add(pos indexPos) sortedIndex {
+	i := sort.Search(len(idx), func(i int) bool {
+		return pos.less(idx[i])
+	})
+	idx = append(idx, indexPos{})
+	copy(idx[i+1:], idx[i:])
+	idx[i] = pos
+	return idx
+}
+
+func (idx sortedIndex) remove(pos indexPos) sortedIndex {
+	i := sort.Search(len(idx), func(i int) bool {
+		return !idx[i].less(pos)
+	})
+	if i < len(idx) && idx[i] == pos {
+		idx = append(idx[:i], idx[i+1:]...)
+	}
+	return idx
+}
+
+// Return the positions on the requested page plus the cursor for the
+// next one, following the same contract as RedisRepo.findPage
+func (idx sortedIndex) page(page FindAllPage) ([]indexPos, string, error) {
+	if page.Size == 0 {
+		page.Size = DefaultPageSize
+	}
+	desc := page.Sort == SortDesc
+
+	// Narrow the index down to the created_after/created_before range,
+	// i.e. idx[lo:hi]
+	rng := rangeOf(page)
+	lo, hi := 0, len(idx)
+	if rng.HasAfter {
+		lo = sort.Search(len(idx), func(i int) bool {
+			return idx[i].Score > rng.After
+		})
+	}
+	if rng.HasBefore {
+		hi = sort.Search(len(idx), func(i int) bool {
+			return idx[i].Score >= rng.Before
+		})
+	}
+
+	// Work out where in the range this page starts (asc), or the index
+	// just past where it starts (desc, since we walk backwards)
+	start := lo
+	if desc {
+		start = hi
+	}
+	if page.Cursor != "" {
+		after, err := decodeCursor(page.Cursor)
+		if err != nil {
+			return nil, "", err
+		}
+		if desc {
+			start = sort.Search(len(idx), func(i int) bool {
+				return !idx[i].less(after)
+			})
+			if start > hi {
+				start = hi
+			}
+		} else {
+			start = sort.Search(len(idx), func(i int) bool {
+				return after.less(idx[i])
+			})
+			if start < lo {
+				start = lo
+			}
+		}
+	}
+
+	// Collect one extra position so we know whether there's a next page
+	var positions []indexPos
+	if desc {
+		for i := start - 1; i >= lo && uint64(len(positions)) <= page.Size; i-- {
+			positions = append(positions, idx[i])
+		}
+	} else {
+		for i := start; i < hi && uint64(len(positions)) <= page.Size; i++ {
+			positions = append(positions, idx[i])
+		}
+	}
+
+	var next string
+	if uint64(len(positions)) > page.Size {
+		positions = positions[:page.Size]
+		next = encodeCursor(positions[len(positions)-1])
+	}
+
+	return positions, next, nil
+}
+
+// Copy the LineItems slice and ShippingAddress so callers can't mutate
+// what we've stored
+func cloneOrder(order model.Order) model.Order {
+	if order.LineItems != nil {
+		order.LineItems = append([]model.LineItem(nil), order.LineItems...)
+	}
+	if order.ShippingAddress != nil {
+		address := *order.ShippingAddress
+		order.ShippingAddress = &address
+	}
+	return order
+}
+
+// Append the history entry and event for a change, like
+// RedisRepo.recordChange. NOTE: Callers must hold the write lock
+func (m *MemoryRepo) recordChange(ctx context.Context, action model.AuditAction, prev *model.Order, order model.Order) {
+	entry := newAuditEntry(ctx, action, prev, order)
+	m.history[order.OrderID] = append(m.history[order.OrderID], entry)
+
+	event := newEvent(entry, cloneOrder(order))
+
+	// Same "<milliseconds>-<sequence>" IDs as Redis streams, so clients
+	// can't tell the two apart
+	ms := entry.At.UnixMilli()
+	if ms <= m.lastEventMs {
+		ms = m.lastEventMs
+		m.lastEventSeq++
+	} else {
+		m.lastEventSeq = 0
+	}
+	m.lastEventMs = ms
+	event.ID = fmt.Sprintf("%d-%d", ms, m.lastEventSeq)
+
+	m.events = append(m.events, event)
+
+	maxLen := m.EventStreamMaxLen
+	if maxLen == 0 {
+		maxLen = DefaultEventStreamMaxLen
+	}
+	if n := int64(len(m.events)); n > maxLen {
+		m.events = append([]model.Event(nil), m.events[n-maxLen:]...)
+	}
+
+	close(m.newEvents)
+	m.newEvents = make(chan struct{})
+}
+
+func (m *MemoryRepo) Insert(ctx context.Context, order model.Order) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, exists := m.orders[order.OrderID]; exists {
+		return ErrAlreadyExists
+	}
+
+	m.insert(ctx, order)
+
+	return nil
+}
+
+func (m *MemoryRepo) InsertMany(ctx context.Context, orders []model.Order, atomic bool) ([]error, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	errs := make([]error, len(orders))
+	seen := make(map[uint64]bool, len(orders))
+	failed := false
+	for i, order := range orders {
+		if _, exists := m.orders[order.OrderID]; exists || seen[order.OrderID] {
+			errs[i] = ErrAlreadyExists
+			failed = true
+		}
+		seen[order.OrderID] = true
+	}
+
+	for i, order := range orders {
+		switch {
+		case errs[i] != nil:
+		case atomic && failed:
+			errs[i] = ErrBatchAborted
+		default:
+			m.insert(ctx, order)
+		}
+	}
+
+	return errs, nil
+}
+
+func (m *MemoryRepo) UpdateMany(ctx context.Context, ids []uint64, fn UpdateFunc) ([]UpdateResult, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	results := make([]UpdateResult, len(ids))
+	first := make(map[uint64]int, len(ids))
+	for i, id := range ids {
+		// Only update an order once, even if it's listed twice
+		if j, seen := first[id]; seen {
+			results[i] = results[j]
+			continue
+		}
+		first[id] = i
+
+		current, exists := m.orders[id]
+		if !exists || current.DeletedAt != nil {
+			results[i] = UpdateResult{Err: ErrNotExist}
+			continue
+		}
+
+		order, err := applyUpdate(current, fn)
+		if err != nil {
+			results[i] = UpdateResult{Err: err}
+			continue
+		}
+
+		m.update(ctx, current, order)
+		results[i] = UpdateResult{Order: order}
+	}
+
+	return results, nil
+}
+
+// NOTE: Callers must hold the write lock
+func (m *MemoryRepo) update(ctx context.Context, prev model.Order, order model.Order) {
+	m.orders[order.OrderID] = cloneOrder(order)
+
+	if prevStatus, status := prev.CurrentStatus(), order.CurrentStatus(); status != prevStatus {
+		pos := positionOf(order)
+		m.statuses[prevStatus] = m.statuses[prevStatus].remove(pos)
+		m.statuses[status] = m.statuses[status].add(pos)
+	}
+
+	m.recordChange(ctx, model.AuditUpdated, &prev, order)
+}
+
+// NOTE: Callers must hold the write lock and have checked the ID is free
+func (m *MemoryRepo) insert(ctx context.Context, order model.Order) {
+	m.orders[order.OrderID] = cloneOrder(order)
+
+	pos := positionOf(order)
+	m.index = m.index.add(pos)
+	m.customers[order.CustomerID] = m.customers[order.CustomerID].add(pos)
+	status := order.CurrentStatus()
+	m.statuses[status] = m.statuses[status].add(pos)
+
+	m.recordChange(ctx, model.AuditCreated, nil, order)
+}
+
+func (m *MemoryRepo) FindByID(ctx context.Context, id uint64) (model.Order, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	order, exists := m.orders[id]
+	if !exists || order.DeletedAt != nil {
+		return model.Order{}, ErrNotExist
+	}
+
+	return cloneOrder(order), nil
+}
+
+func (m *MemoryRepo) History(ctx context.Context, id uint64) ([]model.AuditEntry, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	entries, exists := m.history[id]
+	if !exists {
+		return nil, ErrNotExist
+	}
+
+	return append([]model.AuditEntry(nil), entries...), nil
+}
+
+func (m *MemoryRepo) DeleteByID(ctx context.Context, id uint64, ifRevision uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, exists := m.orders[id]
+	if !exists || order.DeletedAt != nil {
+		return ErrNotExist
+	}
+	if err := checkRevision(order, ifRevision); err != nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	deleted, err := applyUpdate(order, func(o *model.Order) error {
+		o.DeletedAt = &now
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	m.orders[id] = deleted
+
+	// Swap the order from the live indexes into the trash
+	pos := positionOf(order)
+	m.index = m.index.remove(pos)
+	m.customers[order.CustomerID] = m.customers[order.CustomerID].remove(pos)
+	if len(m.customers[order.CustomerID]) == 0 {
+		delete(m.customers, order.CustomerID)
+	}
+	status := order.CurrentStatus()
+	m.statuses[status] = m.statuses[status].remove(pos)
+	m.trash = m.trash.add(pos)
+
+	m.recordChange(ctx, model.AuditDeleted, &order, deleted)
+
+	return nil
+}
+
+func (m *MemoryRepo) Restore(ctx context.Context, id uint64, ifRevision uint64) (model.Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, exists := m.orders[id]
+	if !exists {
+		return model.Order{}, ErrNotExist
+	}
+	if order.DeletedAt == nil {
+		return model.Order{}, ErrNotDeleted
+	}
+	if err := checkRevision(order, ifRevision); err != nil {
+		return model.Order{}, err
+	}
+
+	restored, err := applyUpdate(order, func(o *model.Order) error {
+		o.DeletedAt = nil
+		return nil
+	})
+	if err != nil {
+		return model.Order{}, err
+	}
+	m.orders[id] = restored
+
+	pos := positionOf(restored)
+	m.trash = m.trash.remove(pos)
+	m.index = m.index.add(pos)
+	m.customers[restored.CustomerID] = m.customers[restored.CustomerID].add(pos)
+	status := restored.CurrentStatus()
+	m.statuses[status] = m.statuses[status].add(pos)
+
+	m.recordChange(ctx, model.AuditRestored, &order, restored)
+
+	return cloneOrder(restored), nil
+}
+
+func (m *MemoryRepo) Purge(ctx context.Context, id uint64, ifRevision uint64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	order, exists := m.orders[id]
+	if !exists {
+		return ErrNotExist
+	}
+	if order.DeletedAt == nil {
+		return ErrNotDeleted
+	}
+	if err := checkRevision(order, ifRevision); err != nil {
+		return err
+	}
+
+	m.purge(ctx, order)
+	return nil
+}
+
+// NOTE: There's no index by DeletedAt here, the trash is just scanned
+func (m *MemoryRepo) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var expired []model.Order
+	for _, pos := range m.trash {
+		if order := m.orders[pos.ID]; order.DeletedAt.Before(before) {
+			expired = append(expired, order)
+		}
+	}
+
+	for _, order := range expired {
+		m.purge(ctx, order)
+	}
+
+	return len(expired), nil
+}
+
+// Delete a trashed order for good, keeping its history.
+// NOTE: Callers must hold the write lock
+func (m *MemoryRepo) purge(ctx context.Context, order model.Order) {
+	delete(m.orders, order.OrderID)
+	m.trash = m.trash.remove(positionOf(order))
+	m.recordChange(ctx, model.AuditPurged, &order, order)
+}
+
+// NOTE: Holding the write lock for the whole read-modify-write means
+// updates can never conflict here, unlike RedisRepo
+func (m *MemoryRepo) Update(ctx context.Context, id uint64, ifRevision uint64, fn UpdateFunc) (model.Order, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	current, exists := m.orders[id]
+	if !exists || current.DeletedAt != nil {
+		return model.Order{}, ErrNotExist
+	}
+	if err := checkRevision(current, ifRevision); err != nil {
+		return model.Order{}, err
+	}
+
+	order, err := applyUpdate(current, fn)
+	if err != nil {
+		return model.Order{}, err
+	}
+
+	m.update(ctx, current, order)
+
+	return order, nil
+}
+
+func (m *MemoryRepo) FindAll(ctx context.Context, page FindAllPage) (FindResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if page.Deleted {
+		if page.Status != "" {
+			return FindResult{}, ErrUnsupportedFilter
+		}
+		return m.findPage(m.trash, page)
+	}
+	if page.Status != "" {
+		return m.findPage(m.statuses[page.Status], page)
+	}
+	return m.findPage(m.index, page)
+}
+
+func (m *MemoryRepo) FindByCustomer(ctx context.Context, customerID uuid.UUID, page FindAllPage) (FindResult, error) {
+	if page.Status != "" || page.Deleted {
+		return FindResult{}, ErrUnsupportedFilter
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.findPage(m.customers[customerID], page)
+}
+
+// NOTE: Callers must hold at least the read lock
+func (m *MemoryRepo) findPage(idx sortedIndex, page FindAllPage) (FindResult, error) {
+	positions, next, err := idx.page(page)
+	if err != nil {
+		return FindResult{}, err
+	}
+
+	orders := make([]model.Order, 0, len(positions))
+	for _, pos := range positions {
+		orders = append(orders, cloneOrder(m.orders[pos.ID]))
+	}
+
+	return FindResult{
+		Orders: orders,
+		Next:   next,
+	}, nil
+}
+
+func (m *MemoryRepo) LastEventID(ctx context.Context) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if len(m.events) == 0 {
+		return FirstEventID, nil
+	}
+	return m.events[len(m.events)-1].ID, nil
+}
+
+func (m *MemoryRepo) ReadEvents(ctx context.Context, after string, block time.Duration) ([]model.Event, error) {
+	afterID, err := parseEventID(after)
+	if err != nil {
+		return nil, err
+	}
+
+	timeout := time.NewTimer(block)
+	defer timeout.Stop()
+
+	for {
+		m.mu.RLock()
+		// Events are appended in ID order, so find the first newer one
+		i := sort.Search(len(m.events), func(i int) bool {
+			id, _ := parseEventID(m.events[i].ID)
+			return id.after(afterID)
+		})
+		const count = 100
+		end := len(m.events)
+		if end-i > count {
+			end = i + count
+		}
+		events := append([]model.Event(nil), m.events[i:end]...)
+		wait := m.newEvents
+		m.mu.RUnlock()
+
+		if len(events) > 0 {
+			return events, nil
+		}
+
+		select {
+		case <-wait:
+			// Something was published, go look for it
+		case <-timeout.C:
+			return nil, nil
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,9 @@
+package order
+
+import "testing"
+
+func TestMemoryRepoPaging(t *testing.T) {
+	testPaging(t, func(t *testing.T) Repo {
+		return NewMemoryRepo()
+	})
+}
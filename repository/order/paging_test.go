@@ -0,0 +1,284 @@
+package order
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+)
+
+// NOTE: These pin down the paging contract every Repo implements: orders
+// sorted by (CreatedAt, OrderID), cursors that resume right after the
+// last order of the previous page (even in the middle of orders created
+// at the same time), and exclusive created_after/created_before bounds.
+// Each repo's tests run them with testPaging.
+
+var pagingStart = time.Date(2024, 5, 1, 9, 0, 0, 0, time.UTC)
+
+func at(seconds int) *time.Time {
+	t := pagingStart.Add(time.Duration(seconds) * time.Second)
+	return &t
+}
+
+var pagingCustomer = uuid.MustParse("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+
+// Orders created at the same time are inserted out of ID order, so
+// the tie-break can't pass by accident
+var pagingOrders = []struct {
+	id      uint64
+	created int // seconds after pagingStart
+}{
+	{5, 0}, {2, 0}, {9, 0},
+	{1, 1},
+	{7, 2}, {4, 2},
+	{8, 3},
+	// A batch created in one go, more than a page of every size below
+	// but the last, so cursors land in the middle of it
+	{15, 4}, {11, 4}, {13, 4}, {10, 4}, {14, 4}, {12, 4},
+	// Lost if paging stops at the end of the batch
+	{3, 5},
+}
+
+func insertPagingOrders(t *testing.T, repo Repo) {
+	t.Helper()
+
+	for _, o := range pagingOrders {
+		order := model.Order{
+			OrderID:    o.id,
+			CustomerID: pagingCustomer,
+			Status:     model.StatusPending,
+			CreatedAt:  at(o.created),
+		}
+		if err := repo.Insert(context.Background(), order); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// Follow Next from the first page to the last, returning every order ID
+// in the order they came back
+func walkPages(t *testing.T, find func(FindAllPage) (FindResult, error), page FindAllPage) []uint64 {
+	t.Helper()
+
+	ids := []uint64{}
+	for n := 0; ; n++ {
+		if n > len(pagingOrders)+1 {
+			t.Fatal("paging never finished")
+		}
+
+		res, err := find(page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if uint64(len(res.Orders)) > page.Size {
+			t.Fatalf("got a page of %d orders, want at most %d", len(res.Orders), page.Size)
+		}
+		for _, order := range res.Orders {
+			ids = append(ids, order.OrderID)
+		}
+
+		if res.Next == "" {
+			return ids
+		}
+		// Only the last page can be short
+		if uint64(len(res.Orders)) != page.Size {
+			t.Fatalf("got a page of %d orders with a next page, want %d", len(res.Orders), page.Size)
+		}
+		page.Cursor = res.Next
+	}
+}
+
+func idsOf(orders []model.Order) []uint64 {
+	ids := []uint64{}
+	for _, order := range orders {
+		ids = append(ids, order.OrderID)
+	}
+	return ids
+}
+
+// Run the paging contract against the repo newRepo returns. Each call
+// must return an empty repo.
+func testPaging(t *testing.T, newRepo func(t *testing.T) Repo) {
+	t.Run("walk", func(t *testing.T) {
+		testPagingWalk(t, newRepo(t))
+	})
+	t.Run("default size", func(t *testing.T) {
+		testPagingDefaultSize(t, newRepo(t))
+	})
+	t.Run("cursor before bound", func(t *testing.T) {
+		testPagingCursorBeforeBound(t, newRepo(t))
+	})
+	t.Run("cursor order deleted", func(t *testing.T) {
+		testPagingCursorDeleted(t, newRepo(t))
+	})
+	t.Run("invalid cursor", func(t *testing.T) {
+		testPagingInvalidCursor(t, newRepo(t))
+	})
+}
+
+func testPagingWalk(t *testing.T, repo Repo) {
+	tests := []struct {
+		name   string
+		sort   SortOrder
+		after  *time.Time
+		before *time.Time
+		want   []uint64
+	}{
+		{"asc", SortAsc, nil, nil, []uint64{2, 5, 9, 1, 4, 7, 8, 10, 11, 12, 13, 14, 15, 3}},
+		{"desc", SortDesc, nil, nil, []uint64{3, 15, 14, 13, 12, 11, 10, 8, 7, 4, 1, 9, 5, 2}},
+		// Bounds are exclusive, so ties on the bound are all left out
+		{"asc created_after", SortAsc, at(0), nil, []uint64{1, 4, 7, 8, 10, 11, 12, 13, 14, 15, 3}},
+		{"desc created_after", SortDesc, at(0), nil, []uint64{3, 15, 14, 13, 12, 11, 10, 8, 7, 4, 1}},
+		{"asc created_before", SortAsc, nil, at(2), []uint64{2, 5, 9, 1}},
+		{"desc created_before", SortDesc, nil, at(2), []uint64{1, 9, 5, 2}},
+		{"asc both bounds", SortAsc, at(0), at(3), []uint64{1, 4, 7}},
+		{"desc both bounds", SortDesc, at(0), at(3), []uint64{7, 4, 1}},
+		{"asc batch only", SortAsc, at(3), at(5), []uint64{10, 11, 12, 13, 14, 15}},
+		{"desc batch only", SortDesc, at(3), at(5), []uint64{15, 14, 13, 12, 11, 10}},
+		{"nothing after", SortAsc, at(5), nil, []uint64{}},
+		{"nothing before", SortDesc, nil, at(0), []uint64{}},
+		{"empty range", SortAsc, at(2), at(2), []uint64{}},
+	}
+
+	insertPagingOrders(t, repo)
+	ctx := context.Background()
+
+	for _, tt := range tests {
+		// Page sizes that split the ties every possible way
+		for _, size := range []uint64{1, 2, 3, 4, 50} {
+			t.Run(fmt.Sprintf("%s/size %d", tt.name, size), func(t *testing.T) {
+				page := FindAllPage{
+					Size:          size,
+					Sort:          tt.sort,
+					CreatedAfter:  tt.after,
+					CreatedBefore: tt.before,
+				}
+
+				got := walkPages(t, func(page FindAllPage) (FindResult, error) {
+					return repo.FindAll(ctx, page)
+				}, page)
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("FindAll got %v, want %v", got, tt.want)
+				}
+
+				// Every index pages the same way
+				got = walkPages(t, func(page FindAllPage) (FindResult, error) {
+					return repo.FindByCustomer(ctx, pagingCustomer, page)
+				}, page)
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("FindByCustomer got %v, want %v", got, tt.want)
+				}
+
+				page.Status = model.StatusPending
+				got = walkPages(t, func(page FindAllPage) (FindResult, error) {
+					return repo.FindAll(ctx, page)
+				}, page)
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("FindAll by status got %v, want %v", got, tt.want)
+				}
+			})
+		}
+	}
+}
+
+func testPagingDefaultSize(t *testing.T, repo Repo) {
+	insertPagingOrders(t, repo)
+
+	res, err := repo.FindAll(context.Background(), FindAllPage{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Orders) != len(pagingOrders) || res.Next != "" {
+		t.Errorf("got %d orders and next %q, want all %d on one page", len(res.Orders), res.Next, len(pagingOrders))
+	}
+}
+
+// A cursor from one page, used with a created_after bound past it, picks
+// up from the bound rather than the cursor
+func testPagingCursorBeforeBound(t *testing.T, repo Repo) {
+	insertPagingOrders(t, repo)
+	ctx := context.Background()
+
+	first, err := repo.FindAll(ctx, FindAllPage{Size: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := repo.FindAll(ctx, FindAllPage{Size: 50, Cursor: first.Next, CreatedAfter: at(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := idsOf(res.Orders), []uint64{10, 11, 12, 13, 14, 15, 3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+// Deleting the last order on a page doesn't lose the rest of its ties
+func testPagingCursorDeleted(t *testing.T, repo Repo) {
+	insertPagingOrders(t, repo)
+	ctx := context.Background()
+
+	for _, sort := range []SortOrder{SortAsc, SortDesc} {
+		page := FindAllPage{Size: 2, Sort: sort, CreatedAfter: at(3), CreatedBefore: at(5)}
+		first, err := repo.FindAll(ctx, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(first.Orders) != 2 || first.Next == "" {
+			t.Fatalf("%s: got %v and next %q, want a full first page", sort, idsOf(first.Orders), first.Next)
+		}
+
+		last := first.Orders[1]
+		if err := repo.DeleteByID(ctx, last.OrderID, last.Revision); err != nil {
+			t.Fatal(err)
+		}
+
+		page.Cursor = first.Next
+		res, err := repo.FindAll(ctx, page)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := []uint64{12, 13}
+		if sort == SortDesc {
+			want = []uint64{13, 12}
+		}
+		if got := idsOf(res.Orders); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: got %v, want %v", sort, got, want)
+		}
+
+		if _, err := repo.Restore(ctx, last.OrderID, AnyRevision); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func testPagingInvalidCursor(t *testing.T, repo Repo) {
+	insertPagingOrders(t, repo)
+
+	for _, cursor := range []string{
+		"not base64!",
+		encodeRaw("12345"),     // no ID
+		encodeRaw("abc.1"),     // bad score
+		encodeRaw("1.-1"),      // bad ID
+		encodeRaw("1.2.3.4.5"), // extra parts
+	} {
+		for _, sort := range []SortOrder{SortAsc, SortDesc} {
+			_, err := repo.FindAll(context.Background(), FindAllPage{Cursor: cursor, Sort: sort})
+			if !errors.Is(err, ErrInvalidCursor) {
+				t.Errorf("cursor %q (%s): got error %v, want ErrInvalidCursor", cursor, sort, err)
+			}
+		}
+	}
+}
+
+// Encode raw cursor text the way encodeCursor does
+func encodeRaw(raw string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
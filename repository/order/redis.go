@@ -8,201 +8,1131 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/gaylonalfano/go-redis-crud/codec"
 	"github.com/gaylonalfano/go-redis-crud/model"
+	"github.com/google/uuid"
 	"github.com/redis/go-redis/v9"
 )
 
 type RedisRepo struct {
-	Client *redis.Client
+	// A single node, Sentinel failover, Cluster or Ring client
+	Client redis.UniversalClient
+	// Stream every change is published to, and roughly how many events
+	// it keeps. Zero values use DefaultEventStream/DefaultEventStreamMaxLen.
+	// On a cluster or ring the stream must have the same hash tag as the
+	// rest of our keys (see HasKeyTag).
+	EventStream       string
+	EventStreamMaxLen int64
+	// How each order is stored. Zero value is LayoutJSON
+	Layout Layout
+	// Encodes orders stored with LayoutJSON. Nil uses codec.JSON, but
+	// values written with any codec can be read
+	Codec codec.Codec
+	// Gzip orders stored with LayoutJSON whose encoded value is longer than
+	// this many bytes. Zero never compresses, but compressed values are
+	// always read.
+	CompressAbove int
+
+	// Read-only replicas of Client. Which reads use them is up to
+	// ReadPolicy (zero value is ReadYourWrites), and reads fall back to
+	// Client whenever a replica can't answer.
+	Replicas             []redis.UniversalClient
+	ReadPolicy           ReadPolicy
+	ReadYourWritesWindow time.Duration
+
+	// Which replica is next, and which are being skipped after failing
+	replicaMu        sync.Mutex
+	nextReplica      int
+	replicaDownUntil map[int]time.Time
+}
+
+func (r *RedisRepo) codec() codec.Codec {
+	if r.Codec == nil {
+		return codec.JSON{}
+	}
+	return r.Codec
 }
 
+// NOTE: Every key starts with the {orders} hash tag. Redis Cluster (and
+// Ring) only hash the part inside the braces, so all of them land in the
+// same slot on the same node. That's what lets one MULTI/EXEC (or WATCH)
+// touch an order, its indexes, its history and the event stream together,
+// which a cluster rejects (CROSSSLOT) for keys in different slots.
+// The catch is that orders aren't spread across the cluster's nodes.
+// Tagging per order ({order:ID}) would, but then the indexes, the event
+// stream and multi-order writes (InsertMany, UpdateMany) couldn't be
+// updated in the same transaction as the orders themselves.
+// REF: https://redis.io/docs/reference/cluster-spec/#hash-tags
+const keyTag = "{orders}:"
+
 func generateOrderIDKey(id uint64) string {
-	return fmt.Sprintf("order:%d", id)
+	return fmt.Sprintf("%sorder:%d", keyTag, id)
 }
 
-// NOTE: Redis is a k:v store, stored as string, so we're using the JSON
-// encode (Marshal) / decode (UnMarshal) for this (look at our Order type).
-func (r *RedisRepo) Insert(ctx context.Context, order model.Order) error {
-	data, err := json.Marshal(order) // []byte
+// Each order's audit trail is a list of JSON encoded model.AuditEntry,
+// oldest first
+func orderHistoryKey(id uint64) string {
+	return fmt.Sprintf("%sorder:%d:history", keyTag, id)
+}
+
+// Queue an RPUSH of the entry onto the order's history, so it's written
+// in the same MULTI/EXEC as the change itself
+func appendHistory(ctx context.Context, pipe redis.Pipeliner, id uint64, entry model.AuditEntry) error {
+	data, err := json.Marshal(entry)
 	if err != nil {
-		return fmt.Errorf("Failed to encode order: %w", err)
+		return fmt.Errorf("Failed to encode audit entry: %w", err)
 	}
+	return pipe.RPush(ctx, orderHistoryKey(id), string(data)).Err()
+}
 
-	key := generateOrderIDKey(order.OrderID)
+func (r *RedisRepo) eventStream() string {
+	if r.EventStream == "" {
+		return DefaultEventStream
+	}
+	return r.EventStream
+}
 
-	// U: Atomic transaction that uses a new pipeline client
-	// that wraps queued commands in Redis' MULTI/EXEC. This will
-	// replace our old/original r.Client
-	// REF: https://youtu.be/qCv-q37qjZU?t=822
-	txn := r.Client.TxPipeline()
+// Queue the history entry and event for a change onto the MULTI/EXEC
+// that makes the change, so either all of them happen or none do.
+// For purges, order is the order as it was before being purged.
+func (r *RedisRepo) recordChange(ctx context.Context, pipe redis.Pipeliner, action model.AuditAction, prev *model.Order, order model.Order) error {
+	entry := newAuditEntry(ctx, action, prev, order)
+	if err := appendHistory(ctx, pipe, order.OrderID, entry); err != nil {
+		return fmt.Errorf("Failed to append history: %w", err)
+	}
 
-	// Set() overwrites. SetNX() overwrites if not exists.
-	res := txn.SetNX(ctx, key, string(data), 0)
-	if err := res.Err(); err != nil {
-		txn.Discard()
-		return fmt.Errorf("Failed to set: %w", err)
+	event := newEvent(entry, order)
+	data, err := json.Marshal(event.Order)
+	if err != nil {
+		return fmt.Errorf("Failed to encode event: %w", err)
 	}
 
-	// NOTE: For pagination, we don't want to fetch all orders at once, so
-	// we're adding a Set (Q: Is this a Redis-specific thing?) that only
-	// holds the order IDs for faster FindAll(). However, to keep the db
-	// and the set in sync, we use an atomic transaction that will fail
-	// if either part fails (like Solana txs). Prevents partial state.
-	// NOTE: The set is simply something like this:
-	// "orders": "id1, id2, id3, ..."
-	if err := txn.SAdd(ctx, "orders", key).Err(); err != nil {
-		txn.Discard()
-		return fmt.Errorf("Failed to add to orders set: %w", err)
+	maxLen := r.EventStreamMaxLen
+	if maxLen == 0 {
+		maxLen = DefaultEventStreamMaxLen
 	}
 
-	// U: No buffered Pipeline commands will execute and send to
-	// the Redis server until we commit them
-	if _, err := txn.Exec(ctx); err != nil {
-		return fmt.Errorf("Failed to exec: %w", err)
+	// NOTE: Approx trims with MAXLEN ~, which lets Redis trim whole
+	// macro nodes at a time, much cheaper than an exact trim
+	err = pipe.XAdd(ctx, &redis.XAddArgs{
+		Stream: r.eventStream(),
+		MaxLen: maxLen,
+		Approx: true,
+		Values: map[string]interface{}{
+			"type":       string(event.Type),
+			"order_id":   event.OrderID,
+			"at":         event.At.Format(time.RFC3339Nano),
+			"request_id": event.RequestID,
+			"order":      string(data),
+		},
+	}).Err()
+	if err != nil {
+		return fmt.Errorf("Failed to publish event: %w", err)
 	}
 
 	return nil
 }
 
-// Create a custom error (Redis does have a r.Nil() error)
-var ErrNotExist = errors.New("Order does not exist")
+// U: Orders are indexed in a sorted set (ZSET) scored by CreatedAt, which
+// replaced the unordered "orders" set (see MigrateLegacyIndex)
+const (
+	ordersIndexKey = keyTag + "orders:created"
+	// NOTE: Predates keyTag, and is only ever read by MigrateLegacyIndex
+	legacyOrdersSetKey = "orders"
+	// The trash: deleted orders, with the same layout as ordersIndexKey
+	deletedIndexKey = keyTag + "orders:deleted"
+	// The trash again, but scored by DeletedAt (Unix microseconds) for
+	// PurgeDeleted
+	deletedAtIndexKey = keyTag + "orders:deleted_at"
+)
+
+// Same layout as ordersIndexKey, but only holding one customer's orders
+func customerOrdersKey(customerID uuid.UUID) string {
+	return fmt.Sprintf("%scustomer:%s:orders", keyTag, customerID)
+}
+
+// Same layout as ordersIndexKey, but only holding orders in one status
+func statusOrdersKey(status model.Status) string {
+	return fmt.Sprintf("%sorders:status:%s", keyTag, status)
+}
 
-func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Order, error) {
-	key := generateOrderIDKey(id)
+// The ZSET entry for an order, shared by all of the created-order indexes
+func indexEntry(order model.Order) redis.Z {
+	pos := positionOf(order)
+	return redis.Z{
+		Score:  float64(pos.Score),
+		Member: indexMember(order.OrderID),
+	}
+}
 
-	value, err := r.Client.Get(ctx, key).Result()
-	// Check whether the error is a Redis error, so we can then
-	// return our custom error.
-	if errors.Is(err, redis.Nil) {
-		return model.Order{}, ErrNotExist
-	} else if err != nil {
-		return model.Order{}, fmt.Errorf("Failed to get order: %w", err)
+// Decode a stored value into a proper Order, whichever codec wrote it
+func decodeOrder(value string) (model.Order, error) {
+	var order model.Order
+	if err := codec.Decode([]byte(value), &order); err != nil {
+		return model.Order{}, err
+	}
+	if err := normalizeOrder(&order); err != nil {
+		return model.Order{}, err
+	}
+	return order, nil
+}
+
+// Fill in what orders stored by older versions are missing
+func normalizeOrder(order *model.Order) error {
+	// Orders stored before Status existed only have timestamps
+	order.Status = order.CurrentStatus()
+	// and ones stored before Totals existed need them working out
+	if order.Totals.Total.Currency == "" {
+		if err := order.CalculateTotals(); err != nil {
+			return fmt.Errorf("Failed to calculate order totals: %w", err)
+		}
+	}
+	return nil
+}
+
+// Queue everything that makes up a new order onto a MULTI/EXEC
+func (r *RedisRepo) queueInsert(ctx context.Context, pipe redis.Pipeliner, key string, order model.Order) error {
+	if err := r.queueWriteOrder(ctx, pipe, key, nil, order); err != nil {
+		return err
+	}
+
+	// NOTE: For pagination, we don't want to fetch all orders at once, so
+	// we're adding a sorted set that only holds the order IDs, scored by
+	// CreatedAt, for faster time-ordered FindAll(). However, to keep the db
+	// and the index in sync, we use an atomic transaction that will fail
+	// if either part fails (like Solana txs). Prevents partial state.
+	pipe.ZAdd(ctx, ordersIndexKey, indexEntry(order))
+
+	// Secondary indexes so we can find a customer's orders, or orders
+	// in a given status, without paging through everybody else's
+	pipe.ZAdd(ctx, customerOrdersKey(order.CustomerID), indexEntry(order))
+	pipe.ZAdd(ctx, statusOrdersKey(order.CurrentStatus()), indexEntry(order))
+
+	return r.recordChange(ctx, pipe, model.AuditCreated, nil, order)
+}
+
+// NOTE: Redis is a k:v store, so orders are stored encoded as JSON or as
+// a hash of fields, depending on the Layout (see layout.go)
+func (r *RedisRepo) Insert(ctx context.Context, order model.Order) error {
+	key := generateOrderIDKey(order.OrderID)
+
+	// U: WATCH the key so we can check it's free before queuing anything.
+	// Previously SetNX() quietly didn't set a taken key while the rest of
+	// the transaction still ran, reporting success for a dropped order.
+	txf := func(tx *redis.Tx) error {
+		exists, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return fmt.Errorf("Failed to check order: %w", err)
+		}
+		if exists > 0 {
+			return ErrAlreadyExists
+		}
+
+		// U: Atomic transaction that wraps queued commands in Redis'
+		// MULTI/EXEC. No buffered commands will execute and send to the
+		// Redis server until the function returns.
+		// REF: https://youtu.be/qCv-q37qjZU?t=822
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return r.queueInsert(ctx, pipe, key, order)
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to exec: %w", err)
+		}
+
+		return nil
+	}
+
+	return r.watch(ctx, txf, key)
+}
+
+// U: Batch version of Insert. Rather than a round trip per order, we
+// WATCH every key, check which exist in one pipeline, then write all the
+// new orders in a single MULTI/EXEC.
+func (r *RedisRepo) InsertMany(ctx context.Context, orders []model.Order, atomic bool) ([]error, error) {
+	keys := make([]string, len(orders))
+	for i, order := range orders {
+		keys[i] = generateOrderIDKey(order.OrderID)
+	}
+
+	var errs []error
+	txf := func(tx *redis.Tx) error {
+		errs = make([]error, len(orders))
+
+		// Pipelined reads: one round trip for all the EXISTS checks
+		cmds := make([]*redis.IntCmd, len(keys))
+		_, err := tx.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, key := range keys {
+				cmds[i] = pipe.Exists(ctx, key)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to check orders: %w", err)
+		}
+
+		// Also catch the same ID appearing twice in the batch
+		seen := make(map[string]bool, len(keys))
+		failed := false
+		for i, cmd := range cmds {
+			if cmd.Val() > 0 || seen[keys[i]] {
+				errs[i] = ErrAlreadyExists
+				failed = true
+			}
+			seen[keys[i]] = true
+		}
+
+		if atomic && failed {
+			for i := range errs {
+				if errs[i] == nil {
+					errs[i] = ErrBatchAborted
+				}
+			}
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, order := range orders {
+				if errs[i] != nil {
+					continue
+				}
+				if err := r.queueInsert(ctx, pipe, keys[i], order); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to exec: %w", err)
+		}
+
+		return nil
+	}
+
+	if err := r.watch(ctx, txf, keys...); err != nil {
+		return nil, err
 	}
 
-	// Decode the JSON into a proper Order
+	return errs, nil
+}
+
+func (r *RedisRepo) FindByID(ctx context.Context, id uint64) (model.Order, error) {
 	var order model.Order
-	// NOTE: & seems to specify the 'pointer' of the value
-	err = json.Unmarshal([]byte(value), &order)
+	err := r.read(ctx, func(c redis.Cmdable) error {
+		var err error
+		order, err = r.getLiveOrder(ctx, c, generateOrderIDKey(id))
+		return err
+	})
+	return order, err
+}
+
+func (r *RedisRepo) History(ctx context.Context, id uint64) ([]model.AuditEntry, error) {
+	var values []string
+	err := r.read(ctx, func(c redis.Cmdable) error {
+		var err error
+		values, err = c.LRange(ctx, orderHistoryKey(id), 0, -1).Result()
+		if err != nil {
+			return fmt.Errorf("Failed to get order history: %w", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return model.Order{}, fmt.Errorf("Failed to decode order json: %w", err)
+		return nil, err
 	}
 
-	return order, nil
+	// Every order gets a "created" entry, so no history means no order
+	if len(values) == 0 {
+		return nil, ErrNotExist
+	}
+
+	entries := make([]model.AuditEntry, len(values))
+	for i, value := range values {
+		if err := json.Unmarshal([]byte(value), &entries[i]); err != nil {
+			return nil, fmt.Errorf("Failed to decode audit entry: %w", err)
+		}
+	}
+
+	return entries, nil
 }
 
-func (r *RedisRepo) DeleteByID(ctx context.Context, id uint64) error {
+// U: Deleting only moves the order into the trash, so accidental deletes
+// can be undone with Restore. The order leaves the live indexes for the
+// trash ones, all in one WATCHed transaction like Update.
+func (r *RedisRepo) DeleteByID(ctx context.Context, id uint64, ifRevision uint64) error {
 	key := generateOrderIDKey(id)
 
-	// U: Using atomic transaction pipeline client instead for pagination
-	// to keep 'orders' and the orders set in sync.
-	txn := r.Client.TxPipeline()
+	txf := func(tx *redis.Tx) error {
+		order, err := r.getLiveOrder(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if err := checkRevision(order, ifRevision); err != nil {
+			return err
+		}
 
-	err := txn.Del(ctx, key).Err()
-	if errors.Is(err, redis.Nil) {
-		txn.Discard()
-		return ErrNotExist
-	} else if err != nil {
-		txn.Discard()
-		return fmt.Errorf("Failed to delete order: %w", err)
+		now := time.Now().UTC()
+		deleted, err := applyUpdate(order, func(o *model.Order) error {
+			o.DeletedAt = &now
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// U: Using atomic transaction pipeline instead for pagination
+		// to keep the order key and the orders index in sync.
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if err := r.queueWriteOrder(ctx, pipe, key, &order, deleted); err != nil {
+				return err
+			}
+			// U: Swap the id from the orders, customer and status indexes
+			// into the trash
+			pipe.ZRem(ctx, ordersIndexKey, indexMember(id))
+			pipe.ZRem(ctx, customerOrdersKey(order.CustomerID), indexMember(id))
+			pipe.ZRem(ctx, statusOrdersKey(order.CurrentStatus()), indexMember(id))
+			pipe.ZAdd(ctx, deletedIndexKey, indexEntry(deleted))
+			pipe.ZAdd(ctx, deletedAtIndexKey, redis.Z{
+				Score:  float64(now.UnixMicro()),
+				Member: indexMember(id),
+			})
+			return r.recordChange(ctx, pipe, model.AuditDeleted, &order, deleted)
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to exec: %w", err)
+		}
+
+		return nil
 	}
 
-	// U: Remove the id from the orders set
-	if err := txn.SRem(ctx, "orders", key).Err(); err != nil {
-		txn.Discard()
-		return fmt.Errorf("Failed to remove from orders set: %w", err)
+	return r.watch(ctx, txf, key)
+}
+
+func (r *RedisRepo) Restore(ctx context.Context, id uint64, ifRevision uint64) (model.Order, error) {
+	key := generateOrderIDKey(id)
+	var restored model.Order
+
+	txf := func(tx *redis.Tx) error {
+		order, err := r.getOrder(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if order.DeletedAt == nil {
+			return ErrNotDeleted
+		}
+		if err := checkRevision(order, ifRevision); err != nil {
+			return err
+		}
+
+		restoredOrder, err := applyUpdate(order, func(o *model.Order) error {
+			o.DeletedAt = nil
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// The reverse of DeleteByID
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if err := r.queueWriteOrder(ctx, pipe, key, &order, restoredOrder); err != nil {
+				return err
+			}
+			pipe.ZRem(ctx, deletedIndexKey, indexMember(id))
+			pipe.ZRem(ctx, deletedAtIndexKey, indexMember(id))
+			pipe.ZAdd(ctx, ordersIndexKey, indexEntry(restoredOrder))
+			pipe.ZAdd(ctx, customerOrdersKey(restoredOrder.CustomerID), indexEntry(restoredOrder))
+			pipe.ZAdd(ctx, statusOrdersKey(restoredOrder.CurrentStatus()), indexEntry(restoredOrder))
+			return r.recordChange(ctx, pipe, model.AuditRestored, &order, restoredOrder)
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to exec: %w", err)
+		}
+
+		restored = restoredOrder
+		return nil
 	}
 
-	// Send the queued pipeline command buffers to redis server
-	if _, err := txn.Exec(ctx); err != nil {
-		return fmt.Errorf("Failed to exec: %w", err)
+	if err := r.watch(ctx, txf, key); err != nil {
+		return model.Order{}, err
 	}
 
-	return nil
+	return restored, nil
 }
 
-func (r *RedisRepo) Update(ctx context.Context, order model.Order) error {
-	data, err := json.Marshal(order)
-	if err != nil {
-		return fmt.Errorf("Failed to encode order: %w", err)
+func (r *RedisRepo) Purge(ctx context.Context, id uint64, ifRevision uint64) error {
+	return r.purge(ctx, id, func(order model.Order) error {
+		return checkRevision(order, ifRevision)
+	})
+}
+
+// How many trashed orders PurgeDeleted looks at in each round trip
+const purgeBatchSize = 100
+
+// U: The retention sweep. deletedAtIndexKey is scored by when each order
+// was deleted, so the expired ones are always at the start of it.
+func (r *RedisRepo) PurgeDeleted(ctx context.Context, before time.Time) (int, error) {
+	var purged int
+	cutoff := before.UnixMicro()
+
+	for {
+		members, err := r.Client.ZRangeArgs(ctx, redis.ZRangeArgs{
+			Key:     deletedAtIndexKey,
+			Start:   "-inf",
+			Stop:    "(" + strconv.FormatInt(cutoff, 10),
+			ByScore: true,
+			Count:   purgeBatchSize,
+		}).Result()
+		if err != nil {
+			return purged, fmt.Errorf("Failed to get order ids from index: %w", err)
+		}
+		if len(members) == 0 {
+			return purged, nil
+		}
+
+		for _, member := range members {
+			id, err := parseIndexMember(member)
+			if err != nil {
+				return purged, fmt.Errorf("Failed to parse index member: %w", err)
+			}
+
+			// NOTE: Check DeletedAt again under WATCH, in case the order
+			// was restored and deleted again since we read the index
+			err = r.purge(ctx, id, func(order model.Order) error {
+				if order.DeletedAt.UnixMicro() >= cutoff {
+					return errRetained
+				}
+				return nil
+			})
+			switch {
+			case err == nil:
+				purged++
+			case errors.Is(err, ErrNotExist), errors.Is(err, ErrNotDeleted):
+				// A stale index entry, so drop it or we'd see it forever
+				if err := r.Client.ZRem(ctx, deletedAtIndexKey, member).Err(); err != nil {
+					return purged, fmt.Errorf("Failed to remove from index: %w", err)
+				}
+			case errors.Is(err, errRetained):
+				return purged, nil
+			default:
+				return purged, err
+			}
+		}
 	}
+}
 
-	key := generateOrderIDKey(order.OrderID)
+// Returned by a purge check for orders that haven't been in the trash
+// long enough to be purged
+var errRetained = errors.New("Order is retained")
 
-	// SetXX() only sets/updates value if already exists
-	err = r.Client.SetXX(ctx, key, string(data), 0).Err()
-	if errors.Is(err, redis.Nil) {
-		return ErrNotExist
-	} else if err != nil {
-		// It's an error but not a redis.Nil error type
-		return fmt.Errorf("Failed to update order: %w", err)
+// Delete a trashed order for good if check passes. Its history is kept,
+// so the purge can be audited.
+func (r *RedisRepo) purge(ctx context.Context, id uint64, check func(model.Order) error) error {
+	key := generateOrderIDKey(id)
+
+	txf := func(tx *redis.Tx) error {
+		order, err := r.getOrder(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if order.DeletedAt == nil {
+			return ErrNotDeleted
+		}
+		if err := check(order); err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.ZRem(ctx, deletedIndexKey, indexMember(id))
+			pipe.ZRem(ctx, deletedAtIndexKey, indexMember(id))
+			// NOTE: The history outlives the order, so purges can be audited
+			return r.recordChange(ctx, pipe, model.AuditPurged, &order, order)
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to exec: %w", err)
+		}
+
+		return nil
 	}
 
-	return nil
+	return r.watch(ctx, txf, key)
 }
 
-// In order to support pagination, rather than fetching all at once,
-// we create a new type with a couple properties we can use to help
-type FindAllPage struct {
-	Size   uint64 // aka Count
-	Offset uint64 // aka Cursor
+// How many times Insert, Update and DeleteByID re-run their transaction
+// when another client modifies the order between our WATCH and EXEC
+const maxUpdateRetries = 5
+
+// U: Update is a read-modify-write guarded by WATCH, so two concurrent
+// requests can't both read the same order and blindly overwrite each other.
+// REF: https://redis.io/docs/interact/transactions/#optimistic-locking-using-check-and-set
+func (r *RedisRepo) Update(ctx context.Context, id uint64, ifRevision uint64, fn UpdateFunc) (model.Order, error) {
+	key := generateOrderIDKey(id)
+	var updated model.Order
+
+	txf := func(tx *redis.Tx) error {
+		order, err := r.getLiveOrder(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		if err := checkRevision(order, ifRevision); err != nil {
+			return err
+		}
+
+		// Let the caller apply its changes to a fresh copy
+		updatedOrder, err := applyUpdate(order, fn)
+		if err != nil {
+			return err
+		}
+
+		// NOTE: EXEC fails with redis.TxFailedErr if the watched key
+		// changed since our GET, in which case nothing is written
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			return r.queueUpdate(ctx, pipe, order, updatedOrder)
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to exec: %w", err)
+		}
+
+		updated = updatedOrder
+		return nil
+	}
+
+	if err := r.watch(ctx, txf, key); err != nil {
+		return model.Order{}, err
+	}
+
+	return updated, nil
+}
+
+// Bulk updates are WATCHed in chunks, so a busy order only forces its
+// own chunk to retry rather than the whole batch
+const updateManyChunkSize = 100
+
+// U: Batch version of Update. Each chunk reads every order with a single
+// MGET, applies fn, then writes all the successful ones in one MULTI/EXEC
+// guarded by WATCH, same as Update.
+func (r *RedisRepo) UpdateMany(ctx context.Context, ids []uint64, fn UpdateFunc) ([]UpdateResult, error) {
+	results := make([]UpdateResult, len(ids))
+
+	for start := 0; start < len(ids); start += updateManyChunkSize {
+		end := start + updateManyChunkSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		err := r.updateChunk(ctx, ids[start:end], fn, results[start:end])
+		if errors.Is(err, ErrConflict) {
+			// Nothing in this chunk was written, but other chunks may have been
+			for i := start; i < end; i++ {
+				results[i] = UpdateResult{Err: ErrConflict}
+			}
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return results, nil
+}
+
+func (r *RedisRepo) updateChunk(ctx context.Context, ids []uint64, fn UpdateFunc, results []UpdateResult) error {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = generateOrderIDKey(id)
+	}
+
+	txf := func(tx *redis.Tx) error {
+		currents, err := r.getOrders(ctx, tx, keys)
+		if err != nil {
+			return err
+		}
+
+		var prevs, orders []model.Order
+		first := make(map[uint64]int, len(ids))
+		for i, current := range currents {
+			// Only update an order once, even if it's listed twice
+			if j, seen := first[ids[i]]; seen {
+				results[i] = results[j]
+				continue
+			}
+			first[ids[i]] = i
+
+			if current == nil || current.DeletedAt != nil {
+				results[i] = UpdateResult{Err: ErrNotExist}
+				continue
+			}
+
+			order, err := applyUpdate(*current, fn)
+			if err != nil {
+				results[i] = UpdateResult{Err: err}
+				continue
+			}
+
+			results[i] = UpdateResult{Order: order}
+			prevs = append(prevs, *current)
+			orders = append(orders, order)
+		}
+
+		if len(orders) == 0 {
+			return nil
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i := range orders {
+				if err := r.queueUpdate(ctx, pipe, prevs[i], orders[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("Failed to exec: %w", err)
+		}
+
+		return nil
+	}
+
+	return r.watch(ctx, txf, keys...)
+}
+
+// Queue the write of an updated order (and the index and history changes
+// that go with it) onto a MULTI/EXEC
+func (r *RedisRepo) queueUpdate(ctx context.Context, pipe redis.Pipeliner, prev model.Order, order model.Order) error {
+	// NOTE: With the hash layout, marking an order shipped only writes
+	// the status, shipped_at and revision fields
+	if err := r.queueWriteOrder(ctx, pipe, generateOrderIDKey(order.OrderID), &prev, order); err != nil {
+		return err
+	}
+
+	// Move the order between status indexes in the same MULTI/EXEC
+	if prevStatus, status := prev.CurrentStatus(), order.CurrentStatus(); status != prevStatus {
+		pipe.ZRem(ctx, statusOrdersKey(prevStatus), indexMember(order.OrderID))
+		pipe.ZAdd(ctx, statusOrdersKey(status), indexEntry(order))
+	}
+
+	return r.recordChange(ctx, pipe, model.AuditUpdated, &prev, order)
 }
 
-type FindResult struct {
-	Orders []model.Order
-	Cursor uint64
+// Run txf under WATCH, retrying when the transaction fails because a
+// watched key was modified. Gives up with ErrConflict.
+func (r *RedisRepo) watch(ctx context.Context, txf func(tx *redis.Tx) error, keys ...string) error {
+	for i := 0; i < maxUpdateRetries; i++ {
+		err := r.Client.Watch(ctx, txf, keys...)
+		if errors.Is(err, redis.TxFailedErr) {
+			// Somebody beat us to it, try again with their version
+			continue
+		}
+		return err
+	}
+
+	return ErrConflict
 }
 
 func (r *RedisRepo) FindAll(ctx context.Context, page FindAllPage) (FindResult, error) {
-	// Let's get all the IDs within the specified page range
-	res := r.Client.SScan(ctx, "orders", page.Offset, "*", int64(page.Size))
+	if page.Deleted {
+		if page.Status != "" {
+			return FindResult{}, ErrUnsupportedFilter
+		}
+		return r.readPage(ctx, deletedIndexKey, page)
+	}
+	// U: Filtering by status is just paging over that status' index
+	if page.Status != "" {
+		return r.readPage(ctx, statusOrdersKey(page.Status), page)
+	}
+	return r.readPage(ctx, ordersIndexKey, page)
+}
 
-	// Now let's extract each piece from the res.Result()
-	// NOTE: Using a set returns unordered values. There is an OrderedSet Redis option,
-	// but that could be an extension exercise
-	keys, cursor, err := res.Result()
+func (r *RedisRepo) FindByCustomer(ctx context.Context, customerID uuid.UUID, page FindAllPage) (FindResult, error) {
+	if page.Status != "" || page.Deleted {
+		return FindResult{}, ErrUnsupportedFilter
+	}
+	return r.readPage(ctx, customerOrdersKey(customerID), page)
+}
 
-	// FIXME: res.Result().cursor is always 0, so never get response.next for pagination
-	fmt.Println("res.Result().cursor:", cursor)
-	if err != nil {
-		return FindResult{}, fmt.Errorf("Failed to get order ids from set: %w", err)
+// findPage on a replica, if the ReadPolicy allows it
+func (r *RedisRepo) readPage(ctx context.Context, indexKey string, page FindAllPage) (FindResult, error) {
+	var res FindResult
+	err := r.read(ctx, func(c redis.Cmdable) error {
+		var err error
+		res, err = r.findPage(ctx, c, indexKey, page)
+		return err
+	})
+	return res, err
+}
+
+// Page through any of our created-order indexes (they all share the same
+// scores and members), then load the orders themselves
+func (r *RedisRepo) findPage(ctx context.Context, c redis.Cmdable, indexKey string, page FindAllPage) (FindResult, error) {
+	if page.Size == 0 {
+		page.Size = DefaultPageSize
+	}
+	desc := page.Sort == SortDesc
+
+	// Fetch one extra entry so we know whether there's a next page
+	want := int64(page.Size) + 1
+	var entries []redis.Z
+
+	// NOTE: ZRangeArgs Start/Stop are always min/max, go-redis swaps
+	// them for us when Rev is set. "(" makes a bound exclusive.
+	rng := rangeOf(page)
+	min, max := "-inf", "+inf"
+	if rng.HasAfter {
+		min = "(" + strconv.FormatInt(rng.After, 10)
 	}
+	if rng.HasBefore {
+		max = "(" + strconv.FormatInt(rng.Before, 10)
+	}
+
+	if page.Cursor != "" {
+		after, err := decodeCursor(page.Cursor)
+		if err != nil {
+			return FindResult{}, err
+		}
+		score := strconv.FormatInt(after.Score, 10)
+
+		// Orders sharing the cursor's score are sorted by member (OrderID),
+		// so keep only the ones that come after the cursor's order
+		if rng.contains(after.Score) {
+			ties, err := r.tiesAfter(ctx, c, indexKey, after, desc, want)
+			if err != nil {
+				return FindResult{}, err
+			}
+			entries = ties
+		}
 
-	// Check the 'keys' size. If keys are empty, then return empty list
-	if len(keys) == 0 {
+		// Then continue with the strictly newer (or older) scores, unless
+		// the created_after/created_before filter is already tighter
+		if desc && (!rng.HasBefore || after.Score < rng.Before) {
+			max = "(" + score
+		} else if !desc && (!rng.HasAfter || after.Score > rng.After) {
+			min = "(" + score
+		}
+	}
+
+	if int64(len(entries)) < want {
+		rest, err := c.ZRangeArgsWithScores(ctx, redis.ZRangeArgs{
+			Key:     indexKey,
+			Start:   min,
+			Stop:    max,
+			ByScore: true,
+			Rev:     desc,
+			Count:   want - int64(len(entries)),
+		}).Result()
+		if err != nil {
+			return FindResult{}, fmt.Errorf("Failed to get order ids from index: %w", err)
+		}
+		entries = append(entries, rest...)
+	}
+
+	// Check the 'entries' size. If empty, then return empty list
+	if len(entries) == 0 {
 		return FindResult{
 			Orders: []model.Order{},
-			// Cursor: 0,
 		}, nil
 	}
 
+	// If we got the extra entry there's another page, which starts
+	// right after the last order on this one
+	hasNext := int64(len(entries)) >= want
+	if hasNext {
+		entries = entries[:page.Size]
+	}
+
+	keys := make([]string, len(entries))
+	var last indexPos
+	for i, z := range entries {
+		id, err := parseIndexMember(z.Member.(string))
+		if err != nil {
+			return FindResult{}, fmt.Errorf("Failed to parse index member: %w", err)
+		}
+		keys[i] = generateOrderIDKey(id)
+		last = indexPos{Score: int64(z.Score), ID: id}
+	}
+
+	var next string
+	if hasNext {
+		next = encodeCursor(last)
+	}
+
 	// We only have the IDs. Now time to get all the full values for each key
-	xs, err := r.Client.MGet(ctx, keys...).Result()
+	found, err := r.getOrders(ctx, c, keys)
 	if err != nil {
-		return FindResult{}, fmt.Errorf("Failed to get order values from keys: %w", err)
+		return FindResult{}, err
 	}
 
 	// Unwrap these orders values into an orders slice (for pagination)
-	orders := make([]model.Order, len(xs))
+	orders := make([]model.Order, 0, len(found))
+	for _, order := range found {
+		// A nil order means the key is gone but the index wasn't
+		// updated, so just skip it
+		if order == nil {
+			continue
+		}
+		orders = append(orders, *order)
+	}
+
+	return FindResult{
+		Orders: orders,
+		Next:   next,
+	}, nil
+}
 
-	// Iterate over each element and case each to a string
-	for i, x := range xs {
-		x := x.(string)
-		var order model.Order
+// Up to want index entries sharing the cursor's score that come after
+// the cursor's order. A whole batch can be created in the same
+// microsecond, so there can be far more of these than fit on a page.
+func (r *RedisRepo) tiesAfter(ctx context.Context, c redis.Cmdable, indexKey string, after indexPos, desc bool, want int64) ([]redis.Z, error) {
+	score := strconv.FormatInt(after.Score, 10)
 
-		// Then, Unmarshal (decode) string (x) into an Order struct
-		// which we'll store in our orders slice at the current index (i)
-		err := json.Unmarshal([]byte(x), &order)
+	// NOTE: If the cursor's order is still in the index we can skip
+	// straight past it: its rank, less the number of entries before the
+	// first tie, is how many ties come before it. If it's gone (deleted
+	// since) we start at the first tie and filter below.
+	var offset int64
+	if got, err := c.ZScore(ctx, indexKey, indexMember(after.ID)).Result(); err == nil && int64(got) == after.Score {
+		var rank, before int64
+		if desc {
+			rank, err = c.ZRevRank(ctx, indexKey, indexMember(after.ID)).Result()
+			if err == nil {
+				before, err = c.ZCount(ctx, indexKey, "("+score, "+inf").Result()
+			}
+		} else {
+			rank, err = c.ZRank(ctx, indexKey, indexMember(after.ID)).Result()
+			if err == nil {
+				before, err = c.ZCount(ctx, indexKey, "-inf", "("+score).Result()
+			}
+		}
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return nil, fmt.Errorf("Failed to find cursor in index: %w", err)
+		}
+		if err == nil && rank >= before {
+			offset = rank - before + 1
+		}
+	} else if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("Failed to find cursor in index: %w", err)
+	}
+
+	var entries []redis.Z
+	for int64(len(entries)) < want {
+		count := want - int64(len(entries))
+		ties, err := c.ZRangeArgsWithScores(ctx, redis.ZRangeArgs{
+			Key:     indexKey,
+			Start:   score,
+			Stop:    score,
+			ByScore: true,
+			Rev:     desc,
+			Offset:  offset,
+			Count:   count,
+		}).Result()
 		if err != nil {
-			return FindResult{}, fmt.Errorf("Failed to decode order json: %w", err)
+			return nil, fmt.Errorf("Failed to get order ids from index: %w", err)
+		}
+		for _, z := range ties {
+			id, err := parseIndexMember(z.Member.(string))
+			if err != nil {
+				return nil, fmt.Errorf("Failed to parse index member: %w", err)
+			}
+			if (!desc && id > after.ID) || (desc && id < after.ID) {
+				entries = append(entries, z)
+			}
 		}
 
-		orders[i] = order
+		// Out of ties
+		if int64(len(ties)) < count {
+			break
+		}
+		offset += int64(len(ties))
 	}
+	return entries, nil
+}
 
-	// Return our FindResult with orders and the next cursor value
-	return FindResult{
-		Orders: orders,
-		Cursor: cursor,
-	}, nil
+// MigrateLegacyIndex copies every order referenced by the old, unordered
+// "orders" set into the created-order index, then removes the old set.
+// It's safe to run more than once. Returns how many orders were indexed.
+func (r *RedisRepo) MigrateLegacyIndex(ctx context.Context) (int, error) {
+	var migrated int
+	var cursor uint64
+
+	for {
+		keys, next, err := r.Client.SScan(ctx, legacyOrdersSetKey, cursor, "*", 100).Result()
+		if err != nil {
+			return migrated, fmt.Errorf("Failed to scan orders set: %w", err)
+		}
+
+		// NOTE: The set holds the keys from before keyTag, e.g. "order:1"
+		orderKeys := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if id, err := strconv.ParseUint(strings.TrimPrefix(key, "order:"), 10, 64); err == nil {
+				orderKeys = append(orderKeys, generateOrderIDKey(id))
+			}
+		}
+
+		if len(orderKeys) > 0 {
+			found, err := r.getOrders(ctx, r.Client, orderKeys)
+			if err != nil {
+				return migrated, err
+			}
+
+			members := make([]redis.Z, 0, len(found))
+			for _, order := range found {
+				if order == nil {
+					continue
+				}
+				members = append(members, indexEntry(*order))
+			}
+
+			if len(members) > 0 {
+				if err := r.Client.ZAdd(ctx, ordersIndexKey, members...).Err(); err != nil {
+					return migrated, fmt.Errorf("Failed to add to orders index: %w", err)
+				}
+				migrated += len(members)
+			}
+		}
+
+		// NOTE: Unlike our own cursors, SScan is done when it returns 0
+		cursor = next
+		if cursor == 0 {
+			break
+		}
+	}
+
+	if err := r.Client.Del(ctx, legacyOrdersSetKey).Err(); err != nil {
+		return migrated, fmt.Errorf("Failed to delete orders set: %w", err)
+	}
+
+	return migrated, nil
+}
+
+// RebuildIndexes scans every order:{id} key and (re)adds it to the orders
+// index, its customer's index and its status index (or the trash, for
+// deleted orders), e.g. after restoring a backup or for
+// data written before the customer index existed. Entries are idempotent,
+// so it's safe to run while the service is up. Returns how many orders
+// were indexed.
+func (r *RedisRepo) RebuildIndexes(ctx context.Context) (int, error) {
+	var rebuilt int
+	orderPrefix := keyTag + "order:"
+
+	err := r.scanKeys(ctx, orderPrefix+"*", func(keys []string) error {
+		// Only keep the order:{id} keys themselves
+		orderKeys := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if _, err := strconv.ParseUint(strings.TrimPrefix(key, orderPrefix), 10, 64); err == nil {
+				orderKeys = append(orderKeys, key)
+			}
+		}
+
+		if len(orderKeys) > 0 {
+			found, err := r.getOrders(ctx, r.Client, orderKeys)
+			if err != nil {
+				return err
+			}
+
+			pipe := r.Client.Pipeline()
+			for _, order := range found {
+				if order == nil {
+					continue
+				}
+				if order.DeletedAt != nil {
+					pipe.ZAdd(ctx, deletedIndexKey, indexEntry(*order))
+					pipe.ZAdd(ctx, deletedAtIndexKey, redis.Z{
+						Score:  float64(order.DeletedAt.UnixMicro()),
+						Member: indexMember(order.OrderID),
+					})
+				} else {
+					pipe.ZAdd(ctx, ordersIndexKey, indexEntry(*order))
+					pipe.ZAdd(ctx, customerOrdersKey(order.CustomerID), indexEntry(*order))
+					pipe.ZAdd(ctx, statusOrdersKey(order.CurrentStatus()), indexEntry(*order))
+				}
+				rebuilt++
+			}
+
+			if _, err := pipe.Exec(ctx); err != nil {
+				return fmt.Errorf("Failed to add to indexes: %w", err)
+			}
+		}
+		return nil
+	})
+
+	return rebuilt, err
+}
+
+func (r *RedisRepo) LastEventID(ctx context.Context) (string, error) {
+	msgs, err := r.Client.XRevRangeN(ctx, r.eventStream(), "+", "-", 1).Result()
+	if err != nil {
+		return "", fmt.Errorf("Failed to get last event: %w", err)
+	}
+	if len(msgs) == 0 {
+		return FirstEventID, nil
+	}
+	return msgs[0].ID, nil
+}
+
+// NOTE: A blocking XREAD ties up one pooled connection for up to 'block',
+// so keep it short and call it in a loop rather than blocking forever
+func (r *RedisRepo) ReadEvents(ctx context.Context, after string, block time.Duration) ([]model.Event, error) {
+	if !ValidEventID(after) {
+		return nil, ErrInvalidEventID
+	}
+
+	const count = 100
+	streams, err := r.Client.XRead(ctx, &redis.XReadArgs{
+		Streams: []string{r.eventStream(), after},
+		Count:   count,
+		Block:   block,
+	}).Result()
+	if errors.Is(err, redis.Nil) {
+		// Timed out without any new events
+		return nil, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("Failed to read events: %w", err)
+	}
+
+	var events []model.Event
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			event, err := decodeEvent(msg)
+			if err != nil {
+				return nil, err
+			}
+			events = append(events, event)
+		}
+	}
+
+	return events, nil
+}
+
+// The reverse of the XADD in recordChange
+func decodeEvent(msg redis.XMessage) (model.Event, error) {
+	event := model.Event{ID: msg.ID}
+
+	// NOTE: Stream values always come back from Redis as strings
+	str := func(field string) string {
+		s, _ := msg.Values[field].(string)
+		return s
+	}
+
+	event.Type = model.EventType(str("type"))
+	event.RequestID = str("request_id")
+
+	orderID, err := strconv.ParseUint(str("order_id"), 10, 64)
+	if err != nil {
+		return model.Event{}, fmt.Errorf("Failed to decode event order id: %w", err)
+	}
+	event.OrderID = orderID
+
+	at, err := time.Parse(time.RFC3339Nano, str("at"))
+	if err != nil {
+		return model.Event{}, fmt.Errorf("Failed to decode event time: %w", err)
+	}
+	event.At = at
+
+	order, err := decodeOrder(str("order"))
+	if err != nil {
+		return model.Event{}, err
+	}
+	event.Order = order
+
+	return event, nil
 }
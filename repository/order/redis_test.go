@@ -0,0 +1,44 @@
+package order
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// The RedisRepo tests need a real server, e.g.
+//
+//	REDIS_TEST_ADDR=localhost:6379 go test ./repository/order
+//
+// NOTE: They FLUSHDB the database they use (redisTestDB) before each
+// test, so don't point them at one holding anything you want to keep.
+const redisTestDB = 15
+
+func newTestRedisRepo(t *testing.T, layout Layout) *RedisRepo {
+	t.Helper()
+
+	addr, exists := os.LookupEnv("REDIS_TEST_ADDR")
+	if !exists {
+		t.Skip("REDIS_TEST_ADDR isn't set")
+	}
+
+	client := redis.NewClient(&redis.Options{Addr: addr, DB: redisTestDB})
+	t.Cleanup(func() { client.Close() })
+
+	if err := client.FlushDB(context.Background()).Err(); err != nil {
+		t.Fatalf("Failed to flush redis test db: %v", err)
+	}
+	return &RedisRepo{Client: client, Layout: layout}
+}
+
+func TestRedisRepoPaging(t *testing.T) {
+	for _, layout := range []Layout{LayoutJSON, LayoutHash} {
+		t.Run(string(layout), func(t *testing.T) {
+			testPaging(t, func(t *testing.T) Repo {
+				return newTestRedisRepo(t, layout)
+			})
+		})
+	}
+}
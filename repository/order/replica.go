@@ -0,0 +1,115 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Which reads RedisRepo sends to its Replicas. Writes, and the reads
+// inside them (WATCH), always go to the primary.
+type ReadPolicy string
+
+const (
+	// Never read from the replicas
+	ReadPrimary ReadPolicy = "primary"
+	// Always read from a replica if one is up, however far behind it is
+	ReadReplicas ReadPolicy = "replicas"
+	// Read from a replica, unless the caller wrote something within
+	// ReadYourWritesWindow (see WithLastWrite), so they always see their
+	// own changes. The default.
+	ReadYourWrites ReadPolicy = "read-your-writes"
+)
+
+// Used when RedisRepo.ReadYourWritesWindow is zero. Replicas are normally
+// well under a second behind, this leaves plenty of room.
+const DefaultReadYourWritesWindow = 5 * time.Second
+
+// How long a replica that failed a read is skipped for
+const replicaRetryAfter = 10 * time.Second
+
+type lastWriteKey struct{}
+
+// WithLastWrite records when the caller (e.g. the client's session) last
+// wrote something, for the ReadYourWrites policy
+func WithLastWrite(ctx context.Context, at time.Time) context.Context {
+	return context.WithValue(ctx, lastWriteKey{}, at)
+}
+
+func lastWriteFrom(ctx context.Context) (time.Time, bool) {
+	at, ok := ctx.Value(lastWriteKey{}).(time.Time)
+	return at, ok
+}
+
+func (r *RedisRepo) readYourWritesWindow() time.Duration {
+	if r.ReadYourWritesWindow == 0 {
+		return DefaultReadYourWritesWindow
+	}
+	return r.ReadYourWritesWindow
+}
+
+// Pick the replica to read from, or -1 for the primary. Replicas take
+// turns, skipping any that recently failed.
+func (r *RedisRepo) pickReplica(ctx context.Context) int {
+	if len(r.Replicas) == 0 || r.ReadPolicy == ReadPrimary {
+		return -1
+	}
+	if r.ReadPolicy != ReadReplicas {
+		if at, ok := lastWriteFrom(ctx); ok && time.Since(at) < r.readYourWritesWindow() {
+			return -1
+		}
+	}
+
+	r.replicaMu.Lock()
+	defer r.replicaMu.Unlock()
+
+	now := time.Now()
+	for n := range r.Replicas {
+		i := (r.nextReplica + n) % len(r.Replicas)
+		if now.Before(r.replicaDownUntil[i]) {
+			continue
+		}
+		r.nextReplica = i + 1
+		return i
+	}
+	return -1
+}
+
+func (r *RedisRepo) markReplicaDown(i int) {
+	r.replicaMu.Lock()
+	defer r.replicaMu.Unlock()
+
+	if r.replicaDownUntil == nil {
+		r.replicaDownUntil = make(map[int]time.Time)
+	}
+	r.replicaDownUntil[i] = time.Now().Add(replicaRetryAfter)
+}
+
+// Run a read-only fn against a replica if the ReadPolicy allows it, or
+// the primary otherwise. If the replica can't answer, fn is run again
+// against the primary.
+func (r *RedisRepo) read(ctx context.Context, fn func(c redis.Cmdable) error) error {
+	if i := r.pickReplica(ctx); i >= 0 {
+		err := fn(r.Replicas[i])
+		if !replicaFailed(ctx, err) {
+			return err
+		}
+		fmt.Println("Failed to read from replica, using the primary:", err)
+		r.markReplicaDown(i)
+	}
+	return fn(r.Client)
+}
+
+// Whether err means the replica couldn't answer, rather than the answer
+// being something like "no such order"
+func replicaFailed(ctx context.Context, err error) bool {
+	if err == nil || ctx.Err() != nil {
+		return false
+	}
+	return !errors.Is(err, ErrNotExist) &&
+		!errors.Is(err, ErrInvalidCursor) &&
+		!errors.Is(err, ErrUnsupportedFilter)
+}
@@ -0,0 +1,155 @@
+package order
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gaylonalfano/go-redis-crud/model"
+	"github.com/google/uuid"
+)
+
+// Repo is the datastore contract our handlers depend on. Any type that
+// implements these methods (RedisRepo, MemoryRepo, ...) can be swapped in
+// without the handler package knowing which one it's talking to.
+type Repo interface {
+	Insert(ctx context.Context, order model.Order) error
+	// InsertMany inserts several orders in one go, returning one error per
+	// order (nil if it was inserted). In atomic mode either every order is
+	// inserted or none are, and the orders that were fine get ErrBatchAborted.
+	InsertMany(ctx context.Context, orders []model.Order, atomic bool) ([]error, error)
+	// Orders in the trash don't exist as far as FindByID, Update and
+	// UpdateMany are concerned
+	FindByID(ctx context.Context, id uint64) (model.Order, error)
+	// Update loads the order, applies fn to it and saves the result
+	// atomically with its Revision bumped, returning the saved order.
+	// Pass AnyRevision to skip the revision check.
+	Update(ctx context.Context, id uint64, ifRevision uint64, fn UpdateFunc) (model.Order, error)
+	// UpdateMany applies fn to each order like Update (without a revision
+	// check), in as few round trips as possible. Each order gets its own
+	// result, so one failing doesn't stop the rest being updated.
+	UpdateMany(ctx context.Context, ids []uint64, fn UpdateFunc) ([]UpdateResult, error)
+	// DeleteByID moves the order to the trash by setting its DeletedAt.
+	// It stays there until it's restored or purged.
+	DeleteByID(ctx context.Context, id uint64, ifRevision uint64) error
+	// Restore takes an order back out of the trash
+	Restore(ctx context.Context, id uint64, ifRevision uint64) (model.Order, error)
+	// Purge permanently deletes an order that's in the trash
+	Purge(ctx context.Context, id uint64, ifRevision uint64) error
+	// PurgeDeleted purges every order moved to the trash before 'before',
+	// returning how many were purged
+	PurgeDeleted(ctx context.Context, before time.Time) (int, error)
+	FindAll(ctx context.Context, page FindAllPage) (FindResult, error)
+	// The order's audit trail in chronological order. Still available
+	// after the order itself has been purged
+	History(ctx context.Context, id uint64) ([]model.AuditEntry, error)
+	// Same pagination contract as FindAll, limited to one customer's orders
+	FindByCustomer(ctx context.Context, customerID uuid.UUID, page FindAllPage) (FindResult, error)
+
+	// The ID of the newest event published so far, or FirstEventID if
+	// there are none. Read from it to only get events from now on.
+	LastEventID(ctx context.Context) (string, error)
+	// Events published after the event with ID 'after', oldest first.
+	// Waits up to 'block' for one to arrive, returning none if it times out.
+	ReadEvents(ctx context.Context, after string, block time.Duration) ([]model.Event, error)
+}
+
+// Create a custom error (Redis does have a r.Nil() error)
+var ErrNotExist = errors.New("Order does not exist")
+
+// Returned when inserting an order whose ID is already taken
+var ErrAlreadyExists = errors.New("Order already exists")
+
+// Returned by InsertMany in atomic mode for orders that were fine, but
+// weren't inserted because another order in the batch failed
+var ErrBatchAborted = errors.New("Batch aborted")
+
+// Returned by Restore and Purge for orders that aren't in the trash
+var ErrNotDeleted = errors.New("Order is not deleted")
+
+// Returned by Update when the order kept changing underneath us
+var ErrConflict = errors.New("Order was modified concurrently")
+
+// Returned when the stored order's Revision isn't the one the caller expected
+var ErrRevisionMismatch = errors.New("Order revision does not match")
+
+// Pass as ifRevision to Update/DeleteByID to skip the revision check
+const AnyRevision uint64 = 0
+
+// Checked while the order is locked (or WATCHed), so a matching revision
+// means nobody has changed the order since the caller last read it
+func checkRevision(order model.Order, ifRevision uint64) error {
+	if ifRevision != AnyRevision && order.Revision != ifRevision {
+		return ErrRevisionMismatch
+	}
+	return nil
+}
+
+// The outcome of UpdateMany for one order: the saved order, or why it
+// wasn't updated (ErrNotExist, ErrConflict or an error from the UpdateFunc)
+type UpdateResult struct {
+	Order model.Order
+	Err   error
+}
+
+// Apply fn to a copy of the current order. The ID can't be changed, the
+// totals are worked out again, and the revision is bumped for the new
+// version.
+func applyUpdate(current model.Order, fn UpdateFunc) (model.Order, error) {
+	order := cloneOrder(current)
+	if err := fn(&order); err != nil {
+		return model.Order{}, err
+	}
+	if err := order.CalculateTotals(); err != nil {
+		return model.Order{}, err
+	}
+	order.OrderID = current.OrderID
+	order.Revision = current.Revision + 1
+	return order, nil
+}
+
+// UpdateFunc mutates the current version of an order in place. Returning
+// an error aborts the update and is passed back to the caller unchanged.
+type UpdateFunc func(order *model.Order) error
+
+type SortOrder string
+
+const (
+	SortAsc  SortOrder = "asc"  // oldest orders first
+	SortDesc SortOrder = "desc" // newest orders first
+)
+
+// Used when a FindAllPage doesn't specify a Size
+const DefaultPageSize = 50
+
+// In order to support pagination, rather than fetching all at once,
+// we create a new type with a couple properties we can use to help
+type FindAllPage struct {
+	Size uint64 // aka Count
+	// Opaque token from a previous FindResult.Next. Empty starts from the beginning
+	Cursor string
+	// Defaults to SortAsc (created order)
+	Sort SortOrder
+
+	// Optional filters. Status and Deleted are only supported by FindAll,
+	// and not together
+	Status        model.Status
+	CreatedAfter  *time.Time // exclusive
+	CreatedBefore *time.Time // exclusive
+	// Page through the trash instead of the live orders
+	Deleted bool
+}
+
+var ErrUnsupportedFilter = errors.New("Filter is not supported")
+
+type FindResult struct {
+	Orders []model.Order
+	// Empty when there are no more pages
+	Next string
+}
+
+// Compile-time checks that both datastores satisfy the Repo interface
+var (
+	_ Repo = (*RedisRepo)(nil)
+	_ Repo = (*MemoryRepo)(nil)
+)
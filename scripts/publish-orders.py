@@ -10,14 +10,19 @@ customers = []
 for i in range(100):
     customers.append(uuid.uuid4().__str__())
 
+# Orders are sent in batches via POST /orders/batch rather than one
+# request per order
+BATCH_SIZE = 50
+
+orders = []
 for i in range(120):
     customer = random.choice(customers)
 
     num_line_items = random.randint(1, 10)
 
+    # Each item can only appear once per order, so pick distinct ones
     line_items = []
-    for j in range(num_line_items):
-        item_id = random.choice(item_ids)
+    for item_id in random.sample(item_ids, num_line_items):
         line_items.append(
             {
                 "item_id": item_id,
@@ -26,12 +31,19 @@ for i in range(120):
             }
         )
 
-    order = {
-        "customer_id": customer,
-        "line_items": line_items,
-    }
+    orders.append(
+        {
+            "customer_id": customer,
+            "line_items": line_items,
+        }
+    )
+
+for start in range(0, len(orders), BATCH_SIZE):
+    batch = orders[start : start + BATCH_SIZE]
 
     # If your port is different, change this URL
-    r = requests.post("http://localhost:3000/orders", json=order)
-    r.status_code
-    print("posted order", i + 1)
+    r = requests.post("http://localhost:3000/orders/batch", json=batch)
+    r.raise_for_status()
+
+    created = sum(1 for result in r.json()["results"] if result["status"] == 201)
+    print("posted orders", start + 1, "to", start + len(batch), "created", created)